@@ -0,0 +1,202 @@
+// Package adm sends notifications to the Fire devices through Amazon Device
+// Messaging.
+//
+// Every app authenticates with the Login with Amazon client credentials of
+// its security profile. The sender caches the access token until shortly
+// before it expires and sends one message per registration ID. ADM answers
+// with the current registration ID of the device, which replaces the one
+// sent when they differ.
+package adm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"mobile-push-broadcaster/oauth"
+	"mobile-push-broadcaster/pool"
+)
+
+const (
+	DefaultEndpoint = "https://api.amazon.com"
+	DefaultTokenURL = "https://api.amazon.com/auth/O2/token"
+
+	messagingScope = "messaging:push"
+	maxRetries     = 2
+)
+
+// Result is the outcome of the message sent to one registration ID.
+type Result struct {
+	Token string
+	// RegistrationID is the registration ID ADM answered with, it differs
+	// from Token when the device has a new one.
+	RegistrationID string
+	// Reason is the ADM error reason (InvalidRegistrationId,
+	// Unregistered...) or empty when the message was accepted.
+	Reason string
+	Err    error
+}
+
+// Unregistered reports whether ADM rejected the registration ID itself,
+// meaning it should be removed from the store.
+func (r Result) Unregistered() bool {
+	return r.Reason == "InvalidRegistrationId" || r.Reason == "Unregistered"
+}
+
+// CanonicalID returns the registration ID replacing Token, empty when
+// Token is current.
+func (r Result) CanonicalID() string {
+	if r.Err != nil || r.RegistrationID == r.Token {
+		return ""
+	}
+	return r.RegistrationID
+}
+
+// Sender sends messages for one ADM security profile.
+type Sender struct {
+	ClientID     string
+	ClientSecret string
+	// Endpoint is the ADM API root, DefaultEndpoint when empty.
+	Endpoint string
+	// TokenURL is the Login with Amazon token endpoint, DefaultTokenURL
+	// when empty.
+	TokenURL string
+	Client   *http.Client
+	// Workers is the number of messages sent concurrently.
+	Workers int
+
+	tokens oauth.TokenSource
+}
+
+// NewSender returns a sender authenticating with the client credentials of
+// a security profile.
+func NewSender(clientID string, clientSecret string) *Sender {
+	return &Sender{ClientID: clientID, ClientSecret: clientSecret}
+}
+
+// Send sends data to every registration ID concurrently and returns one
+// result per token, in the order of tokens.
+func (s *Sender) Send(data map[string]string, tokens []string) []Result {
+	results := make([]Result, len(tokens))
+	pool.Run(len(tokens), s.Workers, func(i int) {
+		results[i] = s.SendOne(data, tokens[i])
+	})
+	return results
+}
+
+// SendOne sends data to a single registration ID, retrying transient
+// failures.
+func (s *Sender) SendOne(data map[string]string, token string) Result {
+	body, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return Result{Token: token, Err: err}
+	}
+
+	var result Result
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+		}
+		var retry bool
+		result, retry = s.post(token, body)
+		if !retry {
+			break
+		}
+	}
+	return result
+}
+
+func (s *Sender) post(token string, body []byte) (Result, bool) {
+	result := Result{Token: token}
+
+	accessToken, err := s.AccessToken()
+	if err != nil {
+		result.Err = err
+		return result, true
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(endpoint, "/")+"/messaging/registrations/"+url.PathEscape(token)+"/messages", bytes.NewReader(body))
+	if err != nil {
+		result.Err = err
+		return result, false
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Amzn-Type-Version", "com.amazon.device.messaging.ADMMessage@1.0")
+	req.Header.Set("X-Amzn-Accept-Type", "com.amazon.device.messaging.ADMSendResult@1.0")
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		result.Err = err
+		return result, true
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	var sent struct {
+		RegistrationID string `json:"registrationID"`
+		Reason         string `json:"reason"`
+	}
+	json.Unmarshal(respBody, &sent)
+	if resp.StatusCode == http.StatusOK {
+		result.RegistrationID = sent.RegistrationID
+		if result.RegistrationID == "" {
+			result.RegistrationID = token
+		}
+		return result, false
+	}
+
+	result.Reason = sent.Reason
+	if result.Reason == "" {
+		result.Reason = "UNKNOWN"
+	}
+	result.Err = fmt.Errorf("adm: %s (HTTP %d)", result.Reason, resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		s.tokens.Reset()
+		return result, true
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return result, true
+	}
+	return result, false
+}
+
+func (s *Sender) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+// AccessToken returns a cached Login with Amazon access token, requesting a
+// new one with the client credentials when the cached token is missing or
+// about to expire.
+func (s *Sender) AccessToken() (string, error) {
+	return s.tokens.Token(func() (string, time.Duration, error) {
+		tokenURL := s.TokenURL
+		if tokenURL == "" {
+			tokenURL = DefaultTokenURL
+		}
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"scope":         {messagingScope},
+			"client_id":     {s.ClientID},
+			"client_secret": {s.ClientSecret},
+		}
+		token, lifetime, err := oauth.RequestToken(s.Client, tokenURL, form)
+		if err != nil {
+			return "", 0, fmt.Errorf("adm: %v", err)
+		}
+		return token, lifetime, nil
+	})
+}
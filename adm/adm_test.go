@@ -0,0 +1,69 @@
+package adm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	var tokenRequests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/O2/token", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenRequests, 1)
+		if r.PostFormValue("grant_type") != "client_credentials" || r.PostFormValue("scope") != "messaging:push" || r.PostFormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token":"access","expires_in":3600}`))
+	})
+	mux.HandleFunc("/messaging/registrations/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" || r.Header.Get("X-Amzn-Type-Version") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Data map[string]string `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/messaging/registrations/"), "/messages")
+		switch {
+		case body.Data["title"] != "hello":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"InvalidData"}`))
+		case token == "dead":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"Unregistered"}`))
+		case token == "old":
+			w.Write([]byte(`{"registrationID":"new"}`))
+		default:
+			w.Write([]byte(`{"registrationID":"` + token + `"}`))
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sender := NewSender("client", "secret")
+	sender.Endpoint = server.URL
+	sender.TokenURL = server.URL + "/auth/O2/token"
+
+	results := sender.Send(map[string]string{"title": "hello"}, []string{"a", "dead", "old"})
+	if len(results) != 3 {
+		t.Fatalf("len(results) = %v, want %v", len(results), 3)
+	}
+	if results[0].Err != nil || results[0].CanonicalID() != "" {
+		t.Errorf("results[0] = %+v, want a sent message", results[0])
+	}
+	if !results[1].Unregistered() || results[1].Token != "dead" {
+		t.Errorf("results[1] = %+v, want an unregistered token", results[1])
+	}
+	if results[2].Err != nil || results[2].CanonicalID() != "new" {
+		t.Errorf("results[2] = %+v, want the canonical ID new", results[2])
+	}
+	if n := atomic.LoadInt32(&tokenRequests); n != 1 {
+		t.Errorf("token requests = %v, want %v", n, 1)
+	}
+}
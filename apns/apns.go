@@ -0,0 +1,279 @@
+// Package apns sends iOS notifications through the HTTP/2 APNs provider API.
+//
+// A client authenticates either with a provider token, a JWT signed with the
+// .p8 key of an Apple developer team, or with a TLS client certificate.
+package apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mobile-push-broadcaster/pool"
+)
+
+const (
+	ProductionHost = "https://api.push.apple.com"
+	SandboxHost    = "https://api.sandbox.push.apple.com"
+
+	PriorityImmediate = 10
+	PriorityConserve  = 5
+
+	// Apple rejects provider tokens older than an hour and throttles
+	// refreshes more frequent than every 20 minutes.
+	tokenLifetime = 50 * time.Minute
+)
+
+// Notification is the message pushed to each device token.
+type Notification struct {
+	// Topic is the bundle ID of the app.
+	Topic    string
+	Priority int
+	// Expiration is when APNs stops trying to deliver the notification;
+	// zero means deliver once or drop.
+	Expiration time.Time
+	// PushType is the apns-push-type header, "alert" when empty.
+	PushType string
+	Payload  []byte
+}
+
+// Response is the outcome of the notification sent to one device token.
+type Response struct {
+	DeviceToken string
+	StatusCode  int
+	// Reason is the APNs error reason, e.g. BadDeviceToken or Unregistered.
+	Reason string
+	ApnsID string
+	Err    error
+}
+
+// Sent reports whether APNs accepted the notification.
+func (r Response) Sent() bool {
+	return r.Err == nil && r.StatusCode == http.StatusOK
+}
+
+// Unregistered reports whether the device token is no longer valid and
+// should be removed from the store. DeviceTokenNotForTopic is a failure
+// only, it means the topic is misconfigured rather than the token dead.
+func (r Response) Unregistered() bool {
+	switch {
+	case r.StatusCode == http.StatusGone:
+		return true
+	case r.Reason == "BadDeviceToken", r.Reason == "Unregistered":
+		return true
+	}
+	return false
+}
+
+// Client sends notifications to one APNs host.
+type Client struct {
+	// Host is ProductionHost, SandboxHost or a local stand-in server.
+	Host       string
+	HTTPClient *http.Client
+	// Workers is the number of notifications sent concurrently.
+	Workers int
+
+	token *Token
+}
+
+// NewTokenClient returns a client authenticating with a provider token.
+func NewTokenClient(host string, token *Token) *Client {
+	return &Client{
+		Host:       host,
+		HTTPClient: &http.Client{Transport: &http.Transport{ForceAttemptHTTP2: true}},
+		token:      token,
+	}
+}
+
+// NewCertificateClient returns a client authenticating with the TLS
+// certificate and key stored in PEM files.
+func NewCertificateClient(host string, certFile string, keyFile string) (*Client, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("apns: loading certificate: %v", err)
+	}
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		ForceAttemptHTTP2: true,
+	}
+	return &Client{Host: host, HTTPClient: &http.Client{Transport: transport}}, nil
+}
+
+// Send pushes n to every token concurrently and returns one response per
+// token, in the order of tokens.
+func (c *Client) Send(n *Notification, tokens []string) []Response {
+	responses := make([]Response, len(tokens))
+	pool.Run(len(tokens), c.Workers, func(i int) {
+		responses[i] = c.Push(n, tokens[i])
+	})
+	return responses
+}
+
+// Push sends n to a single device token.
+func (c *Client) Push(n *Notification, deviceToken string) Response {
+	response := c.push(n, deviceToken)
+	if response.Reason == "ExpiredProviderToken" && c.token != nil {
+		c.token.expire()
+		response = c.push(n, deviceToken)
+	}
+	return response
+}
+
+func (c *Client) push(n *Notification, deviceToken string) Response {
+	response := Response{DeviceToken: deviceToken}
+
+	req, err := http.NewRequest("POST", strings.TrimRight(c.Host, "/")+"/3/device/"+deviceToken, bytes.NewReader(n.Payload))
+	if err != nil {
+		response.Err = err
+		return response
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Topic != "" {
+		req.Header.Set("apns-topic", n.Topic)
+	}
+	if n.Priority != 0 {
+		req.Header.Set("apns-priority", strconv.Itoa(n.Priority))
+	}
+	var expiration int64
+	if !n.Expiration.IsZero() {
+		expiration = n.Expiration.Unix()
+	}
+	req.Header.Set("apns-expiration", strconv.FormatInt(expiration, 10))
+	pushType := n.PushType
+	if pushType == "" {
+		pushType = "alert"
+	}
+	req.Header.Set("apns-push-type", pushType)
+	if c.token != nil {
+		bearer, err := c.token.Bearer()
+		if err != nil {
+			response.Err = err
+			return response
+		}
+		req.Header.Set("Authorization", "bearer "+bearer)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		response.Err = err
+		return response
+	}
+	defer resp.Body.Close()
+
+	response.StatusCode = resp.StatusCode
+	response.ApnsID = resp.Header.Get("apns-id")
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return response
+	}
+
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	response.Reason = body.Reason
+	response.Err = fmt.Errorf("apns: %s (HTTP %d)", body.Reason, resp.StatusCode)
+	return response
+}
+
+// Token mints and caches the provider authentication token of a team.
+type Token struct {
+	TeamID string
+	KeyID  string
+	key    *ecdsa.PrivateKey
+
+	lock     sync.Mutex
+	bearer   string
+	issuedAt time.Time
+}
+
+// NewToken returns a provider token signed with key.
+func NewToken(teamID string, keyID string, key *ecdsa.PrivateKey) *Token {
+	return &Token{TeamID: teamID, KeyID: keyID, key: key}
+}
+
+// LoadAuthKey reads the .p8 signing key downloaded from the Apple
+// developer account.
+func LoadAuthKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAuthKey(data)
+}
+
+// ParseAuthKey decodes a PEM encoded .p8 signing key.
+func ParseAuthKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("apns: auth key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("apns: parsing auth key: %v", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("apns: auth key is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// Bearer returns the current JWT, signing a new one when it is older than
+// the refresh interval.
+func (t *Token) Bearer() (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.bearer != "" && time.Since(t.issuedAt) < tokenLifetime {
+		return t.bearer, nil
+	}
+	now := time.Now()
+	bearer, err := t.sign(now)
+	if err != nil {
+		return "", err
+	}
+	t.bearer = bearer
+	t.issuedAt = now
+	return bearer, nil
+}
+
+func (t *Token) expire() {
+	t.lock.Lock()
+	t.bearer = ""
+	t.lock.Unlock()
+}
+
+func (t *Token) sign(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": t.KeyID})
+	claims, _ := json.Marshal(map[string]interface{}{"iss": t.TeamID, "iat": now.Unix()})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, t.key, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("apns: signing token: %v", err)
+	}
+
+	// JWS wants the raw r||s pair, each left-padded to the curve size.
+	size := (t.key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	r.FillBytes(signature[:size])
+	s.FillBytes(signature[size:])
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,153 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSend(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := NewToken("TEAM", "KEY", key)
+
+	var bearers []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("proto = %v, want HTTP/2", r.Proto)
+		}
+		if r.Header.Get("apns-topic") != "com.example.app" || r.Header.Get("apns-priority") != "10" || r.Header.Get("apns-expiration") != "1700000000" {
+			t.Errorf("headers = %v", r.Header)
+		}
+		bearers = append(bearers, r.Header.Get("Authorization"))
+		switch strings.TrimPrefix(r.URL.Path, "/3/device/") {
+		case "gone":
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered","timestamp":1700000000000}`))
+		case "bad":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+		case "topic":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"DeviceTokenNotForTopic"}`))
+		default:
+			w.Header().Set("apns-id", "id")
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := NewTokenClient(server.URL, token)
+	client.HTTPClient = server.Client()
+	client.Workers = 1
+
+	n := &Notification{
+		Topic:      "com.example.app",
+		Priority:   PriorityImmediate,
+		Expiration: time.Unix(1700000000, 0),
+		Payload:    []byte(`{"aps":{"alert":"hi"}}`),
+	}
+	responses := client.Send(n, []string{"ok", "gone", "bad", "topic"})
+
+	if !responses[0].Sent() || responses[0].ApnsID != "id" {
+		t.Errorf("responses[0] = %+v, want a sent notification", responses[0])
+	}
+	if !responses[1].Unregistered() || responses[1].Reason != "Unregistered" {
+		t.Errorf("responses[1] = %+v, want an unregistered token", responses[1])
+	}
+	if !responses[2].Unregistered() || responses[2].Reason != "BadDeviceToken" {
+		t.Errorf("responses[2] = %+v, want a bad token", responses[2])
+	}
+	if responses[3].Sent() || responses[3].Unregistered() {
+		t.Errorf("responses[3] = %+v, want a failure of the topic", responses[3])
+	}
+	for _, bearer := range bearers {
+		if bearer != bearers[0] || !strings.HasPrefix(bearer, "bearer ") {
+			t.Errorf("bearer = %v, want the cached %v", bearer, bearers[0])
+		}
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	token := NewToken("TEAM", "KEY", key)
+
+	first, err := token.Bearer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(first, ".") != 2 {
+		t.Errorf("bearer = %v, want a JWT", first)
+	}
+
+	token.issuedAt = time.Now().Add(-tokenLifetime)
+	second, _ := token.Bearer()
+	if second == first {
+		t.Errorf("bearer was not refreshed after %v", tokenLifetime)
+	}
+}
+
+func TestCertificateClient(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: com.example.app"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalPKCS8PrivateKey(key)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) != 1 || r.TLS.PeerCertificates[0].Subject.CommonName != template.Subject.CommonName {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"reason":"MissingProviderToken"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Errorf("Authorization = %v, want none", r.Header.Get("Authorization"))
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := NewCertificateClient(server.URL, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := client.HTTPClient.Transport.(*http.Transport)
+	transport.TLSClientConfig.RootCAs = server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	response := client.Push(&Notification{Topic: "com.example.app", Payload: []byte(`{}`)}, "ok")
+	if !response.Sent() {
+		t.Errorf("response = %+v, want a sent notification", response)
+	}
+	if _, err := NewCertificateClient(server.URL, certFile, certFile); err == nil {
+		t.Errorf("NewCertificateClient() with no key, want an error")
+	}
+}
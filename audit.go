@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+
+	"mobile-push-broadcaster/dao"
+	"mobile-push-broadcaster/tokencheck"
+)
+
+// maxAuditTokens bounds the invalid tokens listed per platform by an
+// audit.
+const maxAuditTokens = 100
+
+// auditReport describes the invalid tokens stored for an app and a
+// platform.
+type auditReport struct {
+	App      string
+	Platform string
+	Mode     string
+	Checked  int
+	// Invalid counts the invalid tokens per error code.
+	Invalid map[string]int
+	// Tokens lists the first invalid tokens and their error.
+	Tokens []string
+}
+
+// checkToken validates a token with the validation mode of its app and
+// platform, the default mode for an unknown app.
+func checkToken(app string, platform string, token string) *tokencheck.Error {
+	config, _ := getAppConfig(app)
+	return tokencheck.Check(platform, token, config.TokenValidation[platform])
+}
+
+// auditTokens checks the stored tokens of an app on every platform, in
+// mode or the mode configured for the app when mode is nil.
+func auditTokens(app string, mode *string) []auditReport {
+	var reports []auditReport
+	config, _ := getAppConfig(app)
+	for _, platform := range dao.Platforms {
+		report := auditReport{App: app, Platform: platform, Mode: config.TokenValidation[platform], Invalid: make(map[string]int)}
+		if mode != nil {
+			report.Mode = *mode
+		}
+		store.ForEachToken(platform, app, func(r dao.Registration) error {
+			report.Checked++
+			if err := tokencheck.Check(platform, r.Token, report.Mode); err != nil {
+				report.Invalid[err.Code]++
+				if len(report.Tokens) < maxAuditTokens {
+					report.Tokens = append(report.Tokens, r.Token+" "+err.Code)
+				}
+			}
+			return nil
+		})
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// auditCommand reports the invalid tokens already stored, the tokens
+// registered before their validation or with a looser mode.
+func auditCommand(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	app := flags.String("app", "", "app audited, every app when empty")
+	mode := flags.String("mode", "", "validation mode, strict or off, instead of the configured one")
+	if err := commandFlags(flags, args); err != nil {
+		return err
+	}
+	if !tokencheck.ValidMode(*mode) {
+		return errors.New("-mode must be strict or off")
+	}
+	apps := []string{*app}
+	if *app == "" {
+		apps = nil
+		for _, config := range settings.Apps {
+			apps = append(apps, config.Name)
+		}
+	}
+
+	var err error
+	if store, err = openStore(); err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var override *string
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "mode" {
+			override = mode
+		}
+	})
+	for _, name := range apps {
+		for _, report := range auditTokens(name, override) {
+			invalid := 0
+			var codes []string
+			for code, count := range report.Invalid {
+				invalid += count
+				codes = append(codes, code)
+			}
+			sort.Strings(codes)
+			fmt.Printf("%s %s: %d tokens, %d invalid\n", report.App, report.Platform, report.Checked, invalid)
+			for _, code := range codes {
+				fmt.Printf("  %s: %d\n", code, report.Invalid[code])
+			}
+			for _, token := range report.Tokens {
+				fmt.Println("  " + token)
+			}
+		}
+	}
+	return nil
+}
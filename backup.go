@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mobile-push-broadcaster/dao"
+)
+
+// backup streams a consistent snapshot of the DB, taken while the server
+// keeps running.
+func backup(w http.ResponseWriter, r *http.Request) {
+	if settings.DatabaseBackend == dao.MemoryBackend {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "The memory backend has no DB to back up"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"broadcaster-"+time.Now().UTC().Format("20060102T150405Z")+".db\"")
+	size, err := store.Backup(w)
+	if err != nil {
+		log.Println("Backup interrupted after " + strconv.FormatInt(size, 10) + " bytes: " + err.Error())
+		return
+	}
+	log.Println("Backup of " + strconv.FormatInt(size, 10) + " bytes")
+}
+
+// restoreCommand replaces the DB with a snapshot downloaded from /backup.
+// The server must be stopped, it does not reload its tokens: the restore
+// fails while it holds the DB, and it loads the restored tokens when
+// started again.
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	input := flags.String("input", "", "snapshot restored, with the server stopped: a running server does not reload its tokens")
+	if err := commandFlags(flags, args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return errors.New("-input is required")
+	}
+	if settings.DatabaseBackend == dao.MemoryBackend {
+		return errors.New("The memory backend has no DB to restore")
+	}
+
+	options, err := storeOptions()
+	if err != nil {
+		return err
+	}
+	report, err := dao.Restore(*input, databasePath(), options)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Restored a snapshot of schema version %d to %s\n", report.SchemaVersion, databasePath())
+	for _, platform := range dao.Platforms {
+		fmt.Printf("  %s: %d tokens\n", platform, report.Tokens[platform])
+	}
+	fmt.Println("Start the server to load the restored tokens")
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"mobile-push-broadcaster/dao"
+)
+
+// maxBulkTokens bounds the tokens of a bulk request, each request is
+// written in a single transaction.
+const maxBulkTokens = 10000
+
+// bulkToken is an entry of the bulk register and unregister requests.
+// Unregistering only reads its platform and token.
+type bulkToken struct {
+	Platform    string            `json:"platform"`
+	Token       string            `json:"token"`
+	Timezone    string            `json:"timezone"`
+	Tags        []string          `json:"tags"`
+	UserID      string            `json:"user_id"`
+	AppVersion  string            `json:"app_version"`
+	OSVersion   string            `json:"os_version"`
+	Locale      string            `json:"locale"`
+	DeviceModel string            `json:"device_model"`
+	Custom      map[string]string `json:"custom"`
+}
+
+// bulkRequest is the JSON body of the bulk endpoints.
+type bulkRequest struct {
+	Tokens []bulkToken `json:"tokens"`
+}
+
+// readBulkRequest decodes the body of a bulk request of an app. It
+// returns the result of each entry, failed for the invalid ones, and
+// false once an error was rendered. The shape of the tokens is checked
+// when register is set, any token can be unregistered.
+func readBulkRequest(w http.ResponseWriter, r *http.Request, register bool) (string, []bulkToken, []tokenResult, bool) {
+	app := mux.Vars(r)["app"]
+	if _, err := getAppConfig(app); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return "", nil, nil, false
+	}
+	var req bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "Invalid JSON body: " + err.Error()})
+		return "", nil, nil, false
+	}
+	if len(req.Tokens) == 0 || len(req.Tokens) > maxBulkTokens {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "tokens must hold between 1 and " + strconv.Itoa(maxBulkTokens) + " entries"})
+		return "", nil, nil, false
+	}
+
+	results := make([]tokenResult, len(req.Tokens))
+	for i, entry := range req.Tokens {
+		results[i] = tokenResult{Platform: entry.Platform, Token: entry.Token}
+		switch {
+		case entry.Token == "":
+			results[i].Error = "token is required"
+		case !dao.ValidPlatform(entry.Platform):
+			results[i].Error = "Unknown platform: " + entry.Platform
+		case entry.Timezone != "":
+			if _, err := time.LoadLocation(entry.Timezone); err != nil {
+				results[i].Error = "timezone must be an IANA timezone such as Europe/Paris"
+			}
+		}
+		if results[i].Error == "" && register {
+			if err := dao.CheckTags(entry.Tags); err != nil {
+				results[i].Error = err.Error()
+			} else if err := checkToken(app, entry.Platform, entry.Token); err != nil {
+				results[i].Error = err.Message
+				results[i].Code = err.Code
+			}
+		}
+		if results[i].Error != "" {
+			results[i].Status = "failed"
+		}
+	}
+	return app, req.Tokens, results, true
+}
+
+// bulkRegister registers or updates many tokens of an app at once.
+func bulkRegister(w http.ResponseWriter, r *http.Request) {
+	app, entries, results, ok := readBulkRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	var batch []dao.Registration
+	var indexes []int
+	for i, entry := range entries {
+		if results[i].Status == "failed" {
+			continue
+		}
+		batch = append(batch, dao.Registration{
+			Platform: entry.Platform,
+			App:      app,
+			Token:    entry.Token,
+			Timezone: entry.Timezone,
+			Tags:     entry.Tags,
+			UserID:   entry.UserID,
+			Info: dao.TokenInfo{
+				AppVersion:  entry.AppVersion,
+				OSVersion:   entry.OSVersion,
+				Locale:      entry.Locale,
+				DeviceModel: entry.DeviceModel,
+				Custom:      entry.Custom,
+			},
+		})
+		indexes = append(indexes, i)
+	}
+
+	added, err := store.RegisterTokens(batch)
+	if err != nil {
+		log.Println("Bulk register: " + err.Error())
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	for j, i := range indexes {
+		results[i].Status = "updated"
+		if added[j] {
+			results[i].Status = "added"
+		}
+	}
+	log.Println("Bulk register of " + strconv.Itoa(len(batch)) + " tokens in " + app)
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{"status": "success", "results": results})
+}
+
+// bulkUnregister removes many tokens of an app at once.
+func bulkUnregister(w http.ResponseWriter, r *http.Request) {
+	app, entries, results, ok := readBulkRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	var devices []dao.Device
+	var indexes []int
+	for i, entry := range entries {
+		if results[i].Status == "failed" {
+			continue
+		}
+		devices = append(devices, dao.Device{Platform: entry.Platform, Token: entry.Token})
+		indexes = append(indexes, i)
+	}
+
+	removed, err := store.RemoveTokens(app, devices)
+	if err != nil {
+		log.Println("Bulk unregister: " + err.Error())
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	for j, i := range indexes {
+		results[i].Status = "not_found"
+		if removed[j] {
+			results[i].Status = "removed"
+		}
+	}
+	log.Println("Bulk unregister of " + strconv.Itoa(len(devices)) + " tokens in " + app)
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{"status": "success", "results": results})
+}
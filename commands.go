@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+
+	"mobile-push-broadcaster/dao"
+)
+
+// commands are the maintenance commands run instead of the server, as
+//
+//	mobile-push-broadcaster <command> [flags] [dir]
+//
+// where dir holds config.json, the current directory by default.
+var commands = map[string]func(args []string) error{
+	"migrate":    migrateCommand,
+	"export":     exportCommand,
+	"import":     importCommand,
+	"restore":    restoreCommand,
+	"rotate-key": rotateKeyCommand,
+	"audit":      auditCommand,
+}
+
+// commandFlags parses the flags of a command and loads the config of its
+// dir argument.
+func commandFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	dir := "."
+	if flags.NArg() > 0 {
+		dir = flags.Arg(0)
+	}
+	return loadConfig(dir)
+}
+
+// migrateCommand brings the bolt DB to the current schema version, which
+// the server also does when it starts.
+func migrateCommand(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report the changes without writing them")
+	if err := commandFlags(flags, args); err != nil {
+		return err
+	}
+	if settings.DatabaseBackend == dao.MemoryBackend {
+		return errors.New("The memory backend has nothing to migrate")
+	}
+
+	options, err := storeOptions()
+	if err != nil {
+		return err
+	}
+	report, err := dao.Migrate(databasePath(), *dryRun, options)
+	if err != nil {
+		return err
+	}
+	if report.From == report.To {
+		fmt.Printf("Schema version %d, nothing to migrate\n", report.To)
+		return nil
+	}
+	if *dryRun {
+		fmt.Printf("Dry run, the DB is not modified\n")
+	}
+	fmt.Printf("Schema version %d -> %d\n", report.From, report.To)
+	var buckets []string
+	for bucket := range report.Moved {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	for _, bucket := range buckets {
+		fmt.Printf("  %s: %d keys moved\n", bucket, report.Moved[bucket])
+	}
+	for _, key := range report.Skipped {
+		fmt.Printf("  skipped invalid key %s\n", key)
+	}
+	return nil
+}
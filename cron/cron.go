@@ -0,0 +1,228 @@
+// Package cron parses standard five-field cron expressions and computes
+// their next activation times.
+//
+// Fields are minute, hour, day of month, month and day of week. Each field
+// accepts *, values, ranges (1-5), lists (1,15) and steps (*/10, 0-30/5);
+// months and days of week also accept their English abbreviations. The
+// @yearly, @monthly, @weekly, @daily and @hourly macros are supported. As
+// in Vixie cron, when both day fields are restricted a day matching either
+// of them is selected.
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar are set when the day fields are unrestricted.
+	domStar, dowStar bool
+}
+
+type field struct {
+	min, max int
+	names    []string
+}
+
+var (
+	minuteField = field{0, 59, nil}
+	hourField   = field{0, 23, nil}
+	domField    = field{1, 31, nil}
+	monthField  = field{1, 12, []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	dowField    = field{0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a cron expression.
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := macros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron: %q must have 5 fields", expr)
+	}
+
+	var s Schedule
+	var err error
+	if s.minute, err = minuteField.parse(fields[0]); err != nil {
+		return nil, err
+	}
+	if s.hour, err = hourField.parse(fields[1]); err != nil {
+		return nil, err
+	}
+	if s.dom, err = domField.parse(fields[2]); err != nil {
+		return nil, err
+	}
+	if s.month, err = monthField.parse(fields[3]); err != nil {
+		return nil, err
+	}
+	if s.dow, err = dowField.parse(fields[4]); err != nil {
+		return nil, err
+	}
+	// 7 is an alias for Sunday.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*" || fields[2] == "?"
+	s.dowStar = fields[4] == "*" || fields[4] == "?"
+	return &s, nil
+}
+
+// parse returns the bit set of the values matched by a field.
+func (f field) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("cron: invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		low, high := f.min, f.max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if high, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+		default:
+			value, err := f.value(part)
+			if err != nil {
+				return 0, err
+			}
+			low = value
+			if step == 1 {
+				high = value
+			}
+		}
+		if low > high {
+			return 0, fmt.Errorf("cron: invalid range %q", part)
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f field) value(s string) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("cron: %q is not between %d and %d", s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// ErrNoActivation is returned by Next when the schedule never matches, for
+// instance on February 30th.
+var ErrNoActivation = errors.New("cron: the schedule never activates")
+
+// Next returns the first activation strictly after t, in the location of t.
+//
+// The fields match the wall clock of the location. A time repeated when
+// the clocks go back activates once, the first time, and a time skipped
+// when they go forward activates at the end of the gap.
+func (s *Schedule) Next(t time.Time) (time.Time, error) {
+	loc := t.Location()
+	// The wall clock is walked in UTC, where every day has 24 hours.
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	limit := wall.AddDate(5, 0, 0)
+
+	for {
+		var ok bool
+		if wall, ok = s.nextWall(wall, limit); !ok {
+			return time.Time{}, ErrNoActivation
+		}
+		if next := wallTime(wall, loc); next.After(t) {
+			return next, nil
+		}
+		wall = wall.Add(time.Minute)
+	}
+}
+
+// wallTime returns the instant loc shows the wall clock time of wall: the
+// first one when the clocks go back, the end of the gap when they skip it.
+func wallTime(wall time.Time, loc *time.Location) time.Time {
+	t := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, loc)
+	start, _ := t.ZoneBounds()
+	if t.Hour() != wall.Hour() || t.Minute() != wall.Minute() {
+		// t is past the gap, in the zone starting when the clocks jump.
+		return start
+	}
+	if start.IsZero() {
+		return t
+	}
+	// time.Date may pick the second time, in the zone starting when the
+	// clocks go back.
+	_, offset := t.Zone()
+	_, before := start.Add(-time.Second).Zone()
+	earlier := t.Add(-time.Duration(before-offset) * time.Second)
+	if before > offset && earlier.Before(start) && earlier.Hour() == wall.Hour() && earlier.Minute() == wall.Minute() {
+		return earlier
+	}
+	return t
+}
+
+// nextWall returns the first wall clock time from t, in UTC, matching the
+// schedule, false when none comes before limit.
+func (s *Schedule) nextWall(t time.Time, limit time.Time) (time.Time, bool) {
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,85 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("no timezone database")
+	}
+	from := time.Date(2024, 3, 29, 10, 30, 0, 0, paris) // a Friday
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 3, 29, 10, 45, 0, 0, paris)},
+		{"0 9 * * *", time.Date(2024, 3, 30, 9, 0, 0, 0, paris)},
+		{"0 9 * * mon-fri", time.Date(2024, 4, 1, 9, 0, 0, 0, paris)},
+		{"30 18 * * 7", time.Date(2024, 3, 31, 18, 30, 0, 0, paris)},
+		{"0 0 1,15 * *", time.Date(2024, 4, 1, 0, 0, 0, 0, paris)},
+		{"0 8 13 * fri", time.Date(2024, 4, 5, 8, 0, 0, 0, paris)},
+		{"@monthly", time.Date(2024, 4, 1, 0, 0, 0, 0, paris)},
+		{"0 0 29 feb *", time.Date(2028, 2, 29, 0, 0, 0, 0, paris)},
+		// 02:30 does not exist on March 31st, the day of the DST change,
+		// the activation is the end of the gap.
+		{"30 2 31 * *", time.Date(2024, 3, 31, 3, 0, 0, 0, paris)},
+	}
+	for _, test := range tests {
+		s, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%q) error: %v", test.expr, err)
+			continue
+		}
+		next, err := s.Next(from)
+		if err != nil || !next.Equal(test.want) {
+			t.Errorf("Parse(%q).Next() = %v, %v, want %v", test.expr, next, err, test.want)
+		}
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Skip("no timezone database")
+	}
+	s, _ := Parse("30 2 * * *")
+
+	// The clocks go from 02:00 to 03:00 on March 31st.
+	next, _ := s.Next(time.Date(2024, 3, 31, 1, 0, 0, 0, paris))
+	if want := time.Date(2024, 3, 31, 3, 0, 0, 0, paris); !next.Equal(want) {
+		t.Errorf("Next() before the gap = %v, want %v", next, want)
+	}
+	next, _ = s.Next(next)
+	if want := time.Date(2024, 4, 1, 2, 30, 0, 0, paris); !next.Equal(want) {
+		t.Errorf("Next() after the gap = %v, want %v", next, want)
+	}
+
+	// The clocks go from 03:00 back to 02:00 on October 27th, 02:30
+	// activates once.
+	first := time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC).In(paris)
+	next, _ = s.Next(first.Add(-time.Minute))
+	if !next.Equal(first) {
+		t.Errorf("Next() before the repeated hour = %v, want %v", next, first)
+	}
+	next, _ = s.Next(next)
+	if want := time.Date(2024, 10, 28, 2, 30, 0, 0, paris); !next.Equal(want) {
+		t.Errorf("Next() in the repeated hour = %v, want %v", next, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * * 13 *", "*/0 * * * *", "5-1 * * * *", "* * * * funday"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expr)
+		}
+	}
+
+	s, _ := Parse("0 0 30 feb *")
+	if _, err := s.Next(time.Now()); err != ErrNoActivation {
+		t.Errorf("Next() of February 30th = %v, want %v", err, ErrNoActivation)
+	}
+}
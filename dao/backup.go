@@ -0,0 +1,133 @@
+package dao
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// RestoreReport describes a restored snapshot.
+type RestoreReport struct {
+	// SchemaVersion is the version of the snapshot, migrated to
+	// SchemaVersion when older.
+	SchemaVersion int `json:"schema_version"`
+	// Tokens counts the tokens restored, per platform.
+	Tokens map[string]int `json:"tokens"`
+}
+
+func (s *memoryStore) Backup(w io.Writer) (int64, error) {
+	return 0, errors.New("The memory backend has no DB to back up")
+}
+
+func (s *boltStore) Backup(w io.Writer) (int64, error) {
+	var size int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		size, err = tx.WriteTo(w)
+		return err
+	})
+	return size, err
+}
+
+// Restore replaces the DB at path with a snapshot written by Backup. The
+// snapshot is checked, migrated and loaded like a DB opened by the server
+// before replacing the DB.
+//
+// Restoring is offline only: a running server keeps its tokens in memory
+// and would not see the restored ones, so Restore fails after
+// options.Timeout while the DB is locked by a server.
+func Restore(snapshot string, path string, options Options) (RestoreReport, error) {
+	report := RestoreReport{Tokens: make(map[string]int)}
+	version, err := checkSnapshot(snapshot, options)
+	if err != nil {
+		return report, errors.New("Invalid snapshot: " + err.Error())
+	}
+	report.SchemaVersion = version
+
+	// Lock the DB until it is replaced, the server must be stopped.
+	current, err := bolt.Open(path, 0600, &bolt.Options{Timeout: options.Timeout})
+	if err == bolt.ErrTimeout {
+		return report, errors.New("The DB " + path + " is in use, stop the server before restoring")
+	}
+	if err != nil {
+		return report, err
+	}
+	defer current.Close()
+
+	restored := path + ".restore"
+	if err := copyFile(snapshot, restored); err != nil {
+		return report, err
+	}
+	options.Lazy = false
+	s, err := openBolt(restored, options)
+	if err != nil {
+		os.Remove(restored)
+		return report, errors.New("Invalid snapshot: " + err.Error())
+	}
+	for _, platform := range Platforms {
+		for _, app := range s.tokens.apps(platform) {
+			report.Tokens[platform] += s.tokens.count(platform, app)
+		}
+	}
+	if err := s.Close(); err != nil {
+		os.Remove(restored)
+		return report, err
+	}
+	return report, os.Rename(restored, path)
+}
+
+// checkSnapshot checks the pages of a snapshot and returns its schema
+// version.
+func checkSnapshot(snapshot string, options Options) (int, error) {
+	db, err := bolt.Open(snapshot, 0600, &bolt.Options{ReadOnly: true, Timeout: options.Timeout})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var version int
+	err = db.View(func(tx *bolt.Tx) error {
+		// Check reads the pages until the channel is closed, which must
+		// happen before the transaction ends.
+		var errs []string
+		for err := range tx.Check() {
+			errs = append(errs, err.Error())
+		}
+		if len(errs) > 0 {
+			return errors.New(strings.Join(errs, "; "))
+		}
+		if version, err = schemaVersion(tx); err != nil {
+			return err
+		}
+		if version > SchemaVersion {
+			return errors.New("the schema version " + strconv.Itoa(version) + " is newer than the supported version " + strconv.Itoa(SchemaVersion))
+		}
+		return nil
+	})
+	return version, err
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,233 @@
+package dao
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/boltdb/bolt"
+)
+
+// boltStore persists a memoryStore in a bolt DB. The records are not
+// cached, they are read from the DB.
+type boltStore struct {
+	*memoryStore
+	db *bolt.DB
+	// crypt encrypts the DB, nil when it is in plaintext.
+	crypt *sealer
+	// writers counts the writes in progress.
+	writers int32
+}
+
+func openBolt(path string, options Options) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: options.Timeout})
+	if err != nil {
+		return nil, err
+	}
+	if options.BatchDelay > 0 {
+		db.MaxBatchDelay = options.BatchDelay
+	}
+	s := &boltStore{memoryStore: newMemoryStore(), db: db}
+	s.persist = s
+	if options.Lazy {
+		s.tokens = newLazyIndex(s)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		report, err := migrate(tx)
+		if err != nil {
+			return err
+		}
+		if report.From != report.To {
+			log.Println("DB migrated from the schema version " + strconv.Itoa(report.From) + " to " + strconv.Itoa(report.To))
+		}
+		s.crypt, err = checkKey(tx, options.EncryptionKey)
+		return err
+	})
+	if err == nil {
+		err = db.View(s.load)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load fills the memory indexes with the content of the DB, the tokens
+// are left in the DB by a lazy store.
+func (s *boltStore) load(tx *bolt.Tx) error {
+	index, preload := s.tokens.(memoryIndex)
+	return forEachToken(tx, func(kind string, platform string, app string, key string, value []byte) error {
+		if kind == tokensBucket && (!preload || index[platform] == nil) {
+			return nil
+		}
+		token, value, err := s.open(tx, kind, platform, app, key, value)
+		if err != nil {
+			return errors.New("Cannot decrypt the " + kind + " of " + platform + "#" + app + ": " + err.Error())
+		}
+		if token == "" {
+			return nil
+		}
+
+		switch kind {
+		case tokensBucket:
+			index[platform].add(app, token, decodeTokenInfo(value))
+		case timezonesBucket:
+			s.setTimezoneInMem(platform+"#"+app, token, string(value))
+		case tagsBucket:
+			s.setTokenTagsInMem(platform+"#"+app, token, strings.Split(string(value), ","))
+		case usersBucket:
+			s.setTokenUserInMem(platform, app, token, string(value))
+		}
+		return nil
+	})
+}
+
+// open returns the token stored under key in a kind bucket and its value.
+// The token of an encrypted DB is sealed in the value of its tokens
+// bucket, it is empty when the token is not stored.
+func (s *boltStore) open(tx *bolt.Tx, kind string, platform string, app string, key string, value []byte) (string, []byte, error) {
+	if s.crypt == nil {
+		return key, value, nil
+	}
+	if kind == tokensBucket {
+		return s.crypt.openToken(value, tokenContext(kind, platform, app, key))
+	}
+	value, err := s.crypt.open(value, tokenContext(kind, platform, app, key))
+	if err != nil {
+		return "", nil, err
+	}
+	tokens, _ := tokenBucket(tx, tokensBucket, platform, app, false)
+	if tokens == nil || tokens.Get([]byte(key)) == nil {
+		return "", value, nil
+	}
+	token, _, err := s.crypt.openToken(tokens.Get([]byte(key)), tokenContext(tokensBucket, platform, app, key))
+	return token, value, err
+}
+
+// write stores the current values of the changes. A write alone commits
+// at once, the writes of concurrent updates are grouped in a transaction
+// by bolt.DB.Batch, which may run the function again alone when the group
+// fails.
+func (s *boltStore) write(changes []change) error {
+	put := func(tx *bolt.Tx) error {
+		return s.put(tx, changes)
+	}
+	defer atomic.AddInt32(&s.writers, -1)
+	if atomic.AddInt32(&s.writers, 1) == 1 {
+		return s.db.Update(put)
+	}
+	return s.db.Batch(put)
+}
+
+func (s *boltStore) put(tx *bolt.Tx, changes []change) error {
+	for _, c := range changes {
+		value, ok := s.value(tx, c)
+		if !ok {
+			continue
+		}
+		b, err := tokenBucket(tx, c.kind, c.platform, c.app, value != nil)
+		if err != nil {
+			return err
+		}
+		key := s.crypt.lookup(c.token)
+		if c.kind == tokensBucket {
+			stored := b != nil && b.Get([]byte(key)) != nil
+			if stored != (value != nil) {
+				delta := 1
+				if stored {
+					delta = -1
+				}
+				if err := addTokenCount(tx, c.platform, c.app, delta); err != nil {
+					return err
+				}
+			}
+		}
+		if value == nil {
+			if b != nil {
+				err = b.Delete([]byte(key))
+			}
+		} else {
+			context := tokenContext(c.kind, c.platform, c.app, key)
+			if c.kind == tokensBucket {
+				value, err = s.crypt.sealToken(c.token, value, context)
+			} else {
+				value, err = s.crypt.seal(value, context)
+			}
+			if err == nil {
+				err = b.Put([]byte(key), value)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) PutRecord(bucket string, key string, value []byte) error {
+	value, err := s.crypt.seal(value, recordContext(bucket, key))
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (s *boltStore) GetRecord(bucket string, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		v, err := s.crypt.open(v, recordContext(bucket, key))
+		if err != nil {
+			return err
+		}
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return value, err
+}
+func (s *boltStore) DeleteRecord(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) ForEachRecord(bucket string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			v, err := s.crypt.open(v, recordContext(bucket, string(k)))
+			if err != nil {
+				return err
+			}
+			return fn(string(k), v)
+		})
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
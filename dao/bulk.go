@@ -0,0 +1,159 @@
+package dao
+
+import (
+	"errors"
+	"time"
+)
+
+// Platforms lists the platforms of the tokens.
+var Platforms = []string{GCM, APNS, APNSSandbox, WebPush, HMS, ADM}
+
+// tokenPageSize is the number of tokens read at a time by ForEachToken.
+const tokenPageSize = 1000
+
+// ValidPlatform reports whether platform is one of Platforms.
+func ValidPlatform(platform string) bool {
+	for _, p := range Platforms {
+		if p == platform {
+			return true
+		}
+	}
+	return false
+}
+
+// Registration is a token with its metadata, timezone, tags and user, as
+// registered in bulk and iterated by ForEachToken.
+type Registration struct {
+	Platform string    `json:"platform"`
+	App      string    `json:"app"`
+	Token    string    `json:"token"`
+	Timezone string    `json:"timezone,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+	UserID   string    `json:"user_id,omitempty"`
+	Info     TokenInfo `json:"info"`
+}
+
+// RegisterTokens registers a batch of tokens like RegisterToken, and sets
+// the timezone, tags and user of the registrations which have one. The
+// batch is written in a single transaction. added[i] reports whether the
+// token of batch[i] was not registered before.
+func (s *memoryStore) RegisterTokens(batch []Registration) (added []bool, err error) {
+	for _, r := range batch {
+		if !ValidPlatform(r.Platform) {
+			return nil, errors.New("Unknown platform: " + r.Platform)
+		}
+		if err := CheckTags(r.Tags); err != nil {
+			return nil, err
+		}
+	}
+
+	s.writeLock.Lock()
+	added = make([]bool, len(batch))
+	var changes []change
+	for i, r := range batch {
+		var registered []change
+		added[i], registered = s.registerToken(r.Platform, r.App, r.Token, r.Info)
+		changes = append(changes, registered...)
+		if r.Timezone != "" {
+			changes = append(changes, s.setTimezone(r.Platform, r.App, r.Token, r.Timezone)...)
+		}
+		if len(r.Tags) > 0 {
+			changes = append(changes, s.setTags(r.Platform, r.App, r.Token, r.Tags)...)
+		}
+		if r.UserID != "" {
+			changes = append(changes, s.setUser(r.Platform, r.App, r.Token, r.UserID)...)
+		}
+	}
+	s.writeLock.Unlock()
+	return added, s.write(changes)
+}
+
+// RemoveTokens removes a batch of tokens of an app like RemoveToken, in a
+// single transaction. removed[i] reports whether the token of devices[i]
+// was registered.
+func (s *memoryStore) RemoveTokens(app string, devices []Device) (removed []bool, err error) {
+	s.writeLock.Lock()
+	removed = make([]bool, len(devices))
+	var changes []change
+	for i, device := range devices {
+		deleted := s.removeToken(device.Platform, app, device.Token)
+		removed[i] = deleted != nil
+		changes = append(changes, deleted...)
+	}
+	s.writeLock.Unlock()
+	return removed, s.write(changes)
+}
+
+// RemoveTokensIf removes the tokens of devices like RemoveTokens, but only
+// those whose metadata satisfies remove when read under the write lock: a
+// device registered again in the meantime keeps its token.
+func (s *memoryStore) RemoveTokensIf(app string, devices []Device, remove func(info TokenInfo) bool) (removed []bool, err error) {
+	s.writeLock.Lock()
+	removed = make([]bool, len(devices))
+	var changes []change
+	for i, device := range devices {
+		info, ok := s.tokens.info(device.Platform, app, device.Token)
+		if !ok {
+			continue
+		}
+		if info == nil {
+			info = &TokenInfo{}
+		}
+		if !remove(info.copy()) {
+			continue
+		}
+		deleted := s.removeToken(device.Platform, app, device.Token)
+		removed[i] = deleted != nil
+		changes = append(changes, deleted...)
+	}
+	s.writeLock.Unlock()
+	return removed, s.write(changes)
+}
+
+// StampRegistrations records at as the registration time of the devices
+// registered before the registration times were recorded, so that they
+// age from it. The other devices are left unchanged.
+func (s *memoryStore) StampRegistrations(app string, devices []Device, at time.Time) error {
+	return s.update(func() []change {
+		var changes []change
+		for _, device := range devices {
+			info, ok := s.tokens.info(device.Platform, app, device.Token)
+			if !ok || (info != nil && !info.LastRegistered.IsZero()) {
+				continue
+			}
+			s.tokens.register(device.Platform, app, device.Token, TokenInfo{FirstRegistered: at, LastRegistered: at})
+			changes = append(changes, change{tokensBucket, device.Platform, app, device.Token})
+		}
+		return changes
+	})
+}
+
+// ForEachToken calls fn with every token of an app on a platform, until fn
+// returns an error. The tokens and their metadata are read a page at a
+// time, the tokens registered during the iteration may be missed.
+func (s *memoryStore) ForEachToken(platform string, app string, fn func(r Registration) error) error {
+	return s.ForEachTokenPage(platform, app, tokenPageSize, func(tokens []string) error {
+		infos := s.tokens.infos(platform, app, tokens)
+		for _, token := range tokens {
+			info, ok := infos[token]
+			if !ok {
+				continue
+			}
+			r := Registration{
+				Platform: platform,
+				App:      app,
+				Token:    token,
+				Timezone: s.GetTokenTimezone(platform, app, token),
+				Tags:     s.GetTokenTags(platform, app, token),
+				UserID:   s.GetTokenUser(platform, app, token),
+			}
+			if info != nil {
+				r.Info = info.copy()
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
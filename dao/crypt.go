@@ -0,0 +1,276 @@
+package dao
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// Encryption at rest of the bolt DB. With an encryption key the tokens are
+// stored under their keyed hash, HMAC-SHA256, so that they can still be
+// found and removed, and the values are sealed with AES-GCM. The value of
+// a token also seals the token itself, which its hash does not give back.
+// The records are sealed, their keys are kept.
+//
+// meta/key_check identifies the key of an encrypted DB, a DB without it is
+// in plaintext.
+
+// EncryptionKeySize is the size of the encryption keys.
+const EncryptionKeySize = 32
+
+const keyCheckKey = "key_check"
+
+// sealer encrypts the values of the DB. A nil sealer keeps them in
+// plaintext.
+type sealer struct {
+	aead cipher.AEAD
+	// mac is the key of the lookup hashes.
+	mac []byte
+}
+
+// newSealer returns the sealer of key, nil for a nil key.
+func newSealer(key []byte) (*sealer, error) {
+	if key == nil {
+		return nil, nil
+	}
+	if len(key) != EncryptionKeySize {
+		return nil, errors.New("The encryption key must be " + strconv.Itoa(EncryptionKeySize) + " bytes long")
+	}
+	block, err := aes.NewCipher(deriveKey(key, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead, mac: deriveKey(key, "lookup")}, nil
+}
+
+// deriveKey returns a key for a single purpose, the same key never both
+// encrypts and hashes.
+func deriveKey(key []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+// check identifies the key without revealing it.
+func (s *sealer) check() []byte {
+	return []byte(hex.EncodeToString(deriveKey(s.mac, "key check")[:8]))
+}
+
+// lookup returns the key under which a token is stored.
+func (s *sealer) lookup(token string) string {
+	if s == nil {
+		return token
+	}
+	h := hmac.New(sha256.New, s.mac)
+	h.Write([]byte(token))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// seal encrypts value, bound to its location in the DB by context so that
+// it cannot be moved to another key.
+func (s *sealer) seal(value []byte, context string) ([]byte, error) {
+	if s == nil {
+		return value, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(value)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, value, []byte(context)), nil
+}
+
+func (s *sealer) open(sealed []byte, context string) ([]byte, error) {
+	if s == nil {
+		return sealed, nil
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("The sealed value is truncated")
+	}
+	nonce := sealed[:s.aead.NonceSize()]
+	return s.aead.Open(nil, nonce, sealed[len(nonce):], []byte(context))
+}
+
+// sealToken seals the value of a token with the token, which its lookup
+// key does not give back.
+func (s *sealer) sealToken(token string, value []byte, context string) ([]byte, error) {
+	if s == nil {
+		return value, nil
+	}
+	payload := binary.AppendUvarint(nil, uint64(len(token)))
+	payload = append(payload, token...)
+	return s.seal(append(payload, value...), context)
+}
+
+func (s *sealer) openToken(sealed []byte, context string) (string, []byte, error) {
+	payload, err := s.open(sealed, context)
+	if err != nil || s == nil {
+		return "", payload, err
+	}
+	size, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < size {
+		return "", nil, errors.New("The sealed token is invalid")
+	}
+	return string(payload[n : n+int(size)]), payload[n+int(size):], nil
+}
+
+func tokenContext(kind string, platform string, app string, key string) string {
+	return appsBucket + "/" + app + "/" + platform + "/" + kind + "/" + key
+}
+
+func recordContext(bucket string, key string) string {
+	return bucket + "/" + key
+}
+
+// checkKey returns the sealer of key after checking that it is the key of
+// the DB. An empty DB is encrypted with the key.
+func checkKey(tx *bolt.Tx, key []byte) (*sealer, error) {
+	crypt, err := newSealer(key)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return nil, err
+	}
+	check := meta.Get([]byte(keyCheckKey))
+	switch {
+	case check == nil && crypt == nil:
+		return nil, nil
+	case check == nil:
+		if !emptyDB(tx) {
+			return nil, errors.New("The DB is not encrypted, run the rotate-key command to encrypt it")
+		}
+		return crypt, meta.Put([]byte(keyCheckKey), crypt.check())
+	case crypt == nil:
+		return nil, errors.New("The DB is encrypted, an encryption key is required")
+	case !hmac.Equal(check, crypt.check()):
+		return nil, errors.New("The encryption key is not the key of the DB")
+	}
+	return crypt, nil
+}
+
+// emptyDB reports whether the DB holds no token and no record.
+func emptyDB(tx *bolt.Tx) bool {
+	empty := true
+	tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		if string(name) != metaBucket {
+			if k, _ := b.Cursor().First(); k != nil {
+				empty = false
+			}
+		}
+		return nil
+	})
+	return empty
+}
+
+// RotationReport describes a key rotation.
+type RotationReport struct {
+	// Encrypted reports whether the DB is encrypted after the rotation.
+	Encrypted bool `json:"encrypted"`
+	Tokens    int  `json:"tokens"`
+	Records   int  `json:"records"`
+}
+
+// RotateKey encrypts the DB at path with newKey, or decrypts it when
+// newKey is nil. options.EncryptionKey is the current key, nil when the DB
+// is in plaintext. The DB is rewritten to a new file which replaces it, so
+// that no page of the previous file remains.
+func RotateKey(path string, options Options, newKey []byte) (RotationReport, error) {
+	report := RotationReport{Encrypted: newKey != nil}
+	crypt, err := newSealer(newKey)
+	if err != nil {
+		return report, err
+	}
+	options.Lazy = false
+	s, err := openBolt(path, options)
+	if err != nil {
+		return report, err
+	}
+	defer s.Close()
+
+	rotated := path + ".rotate"
+	os.Remove(rotated)
+	db, err := bolt.Open(rotated, 0600, nil)
+	if err != nil {
+		return report, err
+	}
+	target := &boltStore{memoryStore: s.memoryStore, db: db, crypt: crypt}
+	err = s.db.View(func(from *bolt.Tx) error {
+		return db.Update(func(to *bolt.Tx) error {
+			if err := s.copyRecords(from, to, crypt, &report); err != nil {
+				return err
+			}
+			var changes []change
+			for _, platform := range Platforms {
+				for _, app := range s.tokens.apps(platform) {
+					for _, token := range s.tokens.snapshot(platform, app) {
+						for _, kind := range tokenKinds {
+							changes = append(changes, change{kind, platform, app, token})
+						}
+						report.Tokens++
+					}
+				}
+			}
+			return target.put(to, changes)
+		})
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(rotated)
+		return report, err
+	}
+	return report, os.Rename(rotated, path)
+}
+
+// copyRecords copies the meta bucket and the records to another DB, the
+// records sealed with crypt.
+func (s *boltStore) copyRecords(from *bolt.Tx, to *bolt.Tx, crypt *sealer, report *RotationReport) error {
+	return from.ForEach(func(name []byte, b *bolt.Bucket) error {
+		bucket := string(name)
+		if bucket == appsBucket {
+			return nil
+		}
+		copied, err := to.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		if bucket == metaBucket {
+			err = b.ForEach(func(k, v []byte) error {
+				if string(k) == keyCheckKey {
+					return nil
+				}
+				return copied.Put(k, v)
+			})
+			if err == nil && crypt != nil {
+				err = copied.Put([]byte(keyCheckKey), crypt.check())
+			}
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			value, err := s.crypt.open(v, recordContext(bucket, string(k)))
+			if err != nil {
+				return errors.New("Cannot decrypt the record " + bucket + "/" + string(k) + ": " + err.Error())
+			}
+			if value, err = crypt.seal(value, recordContext(bucket, string(k))); err != nil {
+				return err
+			}
+			report.Records++
+			return copied.Put(k, value)
+		})
+	})
+}
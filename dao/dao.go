@@ -1,204 +1,394 @@
+// Package dao stores the registered tokens, their metadata and the records
+// of the server.
+//
+// Every Store keeps its tokens indexed in memory, unless the bolt Store is
+// lazy. The bolt Store also writes each change to its DB file and loads it
+// back when opened, the memory Store forgets everything when the process
+// exits.
 package dao
 
 import (
+	"errors"
+	"io"
 	"log"
-	"fmt"
-	"sync"
 	"strings"
+	"sync"
+	"time"
+
 	"github.com/boltdb/bolt"
 )
 
-var gcmMemLock sync.RWMutex
-var apnsMemLock sync.RWMutex
-var apnsSandboxMemLock sync.RWMutex
+// Platforms, also used as key prefix in the DB.
+const (
+	GCM         = "gcm"
+	APNS        = "apns"
+	APNSSandbox = "apnssandbox"
+	WebPush     = "webpush"
+	HMS         = "hms"
+	ADM         = "adm"
+)
+
+// tokensBucket holds the tokens of an app on a platform, see schema.go.
+const tokensBucket = "tokens"
+
+// Backends of a Store.
+const (
+	BoltBackend   = "bolt"
+	MemoryBackend = "memory"
+)
+
+// Store gives access to the tokens of each platform and app, their
+// metadata and the records. The changes are applied in memory first, the
+// errors returned are those of their persistence.
+type Store interface {
+	// GetTokens returns a snapshot of the tokens of an app, in no
+	// particular order. It is not modified by later registrations.
+	GetTokens(platform string, app string) []string
+	GetNbTokens(platform string, app string) int
+	HasToken(platform string, app string, token string) bool
+	AddToken(platform string, app string, token string) error
+	// RegisterToken adds a token or updates the metadata of a registered
+	// one, see TokenInfo.
+	RegisterToken(platform string, app string, token string, info TokenInfo) error
+	// GetTokenInfo returns the metadata of a token, false when the token
+	// is not registered.
+	GetTokenInfo(platform string, app string, token string) (TokenInfo, bool)
+	RegisterTokens(batch []Registration) (added []bool, err error)
+	RemoveTokens(app string, devices []Device) (removed []bool, err error)
+	// RemoveTokensIf removes the tokens whose metadata satisfies remove,
+	// checked again under the write lock.
+	RemoveTokensIf(app string, devices []Device, remove func(info TokenInfo) bool) (removed []bool, err error)
+	// StampRegistrations gives the devices with no registration time the
+	// registration time at.
+	StampRegistrations(app string, devices []Device, at time.Time) error
+	ForEachToken(platform string, app string, fn func(r Registration) error) error
+	// ForEachTokenPage calls fn with the tokens of an app, size at a time,
+	// until fn returns an error. The tokens registered during the
+	// iteration may be missed.
+	ForEachTokenPage(platform string, app string, size int, fn func(tokens []string) error) error
+	// RemoveToken removes a token and its metadata.
+	RemoveToken(platform string, app string, token string) error
+	// ReplaceToken swaps a token for the canonical ID reported by a
+	// provider, keeping the metadata, timezone, tags and user of the
+	// device. The swap is written in a single transaction.
+	ReplaceToken(platform string, app string, oldToken string, newToken string) error
+	// CleanTokens removes the removed tokens and swaps the keys of
+	// replaced for their canonical ID, like RemoveToken and ReplaceToken,
+	// in a single transaction.
+	CleanTokens(platform string, app string, removed []string, replaced map[string]string) error
 
-var gcmTokens = make(map[string][]string)
-var apnsTokens = make(map[string][]string)
-var apnsSandboxTokens = make(map[string][]string)
+	// SetTokenTimezone records the IANA timezone of a token, an empty
+	// timezone forgets it.
+	SetTokenTimezone(platform string, app string, token string, timezone string) error
+	GetTokenTimezone(platform string, app string, token string) string
+	// GetTimezones returns the timezones of the tokens of an app, read a
+	// page at a time, with "" when some tokens have none.
+	GetTimezones(platform string, app string) []string
 
-var db *bolt.DB
+	// SetTokenTags replaces the tags of a token, which cannot contain a
+	// comma.
+	SetTokenTags(platform string, app string, token string, tags []string) error
+	GetTokenTags(platform string, app string, token string) []string
+	// GetTokensWithTag returns the tokens of an app carrying a tag, from
+	// the tag index.
+	GetTokensWithTag(platform string, app string, tag string) []string
 
-func init() {
-	db, _ = bolt.Open("broadcaster.db", 0600, nil)
-    // defer db.Close()
+	// SetTokenUser records the user of a token, an empty user forgets it.
+	SetTokenUser(platform string, app string, token string, user string) error
+	GetTokenUser(platform string, app string, token string) string
+	// GetUserDevices returns the devices of a user on every platform,
+	// sorted by platform and token.
+	GetUserDevices(app string, user string) []Device
+
+	// PutRecord stores value under key in a bucket of records.
+	PutRecord(bucket string, key string, value []byte) error
+	// GetRecord returns the value stored under key, nil if there is none.
+	GetRecord(bucket string, key string) ([]byte, error)
+	DeleteRecord(bucket string, key string) error
+	// ForEachRecord calls fn for every record of the bucket in key order.
+	// The value is only valid during the call.
+	ForEachRecord(bucket string, fn func(key string, value []byte) error) error
+
+	// Backup writes a consistent snapshot of the DB to w, to be restored
+	// by Restore, and returns its size.
+	Backup(w io.Writer) (int64, error)
+	Close() error
 }
 
-func GetGCMTokens(app string) []string {
-	gcmMemLock.RLock()
-	defer gcmMemLock.RUnlock()
-	return gcmTokens[app]
+// Options configures the Store built by Open.
+type Options struct {
+	// Backend is BoltBackend, the default, or MemoryBackend.
+	Backend string
+	// Timeout bounds the wait for the lock of the bolt DB file, 0 waits
+	// forever.
+	Timeout time.Duration
+	// BatchDelay is the time a write waits for others to commit with,
+	// see bolt.DB.MaxBatchDelay. 0 keeps the bolt default.
+	BatchDelay time.Duration
+	// EncryptionKey encrypts the bolt DB when set, see RotateKey to
+	// encrypt an existing DB or change its key.
+	EncryptionKey []byte
+	// Lazy keeps the tokens of the bolt DB out of memory: they are read
+	// from the DB when needed, a page at a time by the iterations. The
+	// timezones, tags and users are still indexed in memory.
+	Lazy bool
 }
 
-func GetNbGCMTokens(app string) int {
-	gcmMemLock.RLock()
-	defer gcmMemLock.RUnlock()
-	return len(gcmTokens[app])
+// Open builds the Store of options.Backend. The bolt Store keeps its DB in
+// the file at path, created if needed, and loads the tokens it holds.
+func Open(path string, options Options) (Store, error) {
+	switch options.Backend {
+	case "", BoltBackend:
+		return openBolt(path, options)
+	case MemoryBackend:
+		return NewMemoryStore(), nil
+	}
+	return nil, errors.New("Unknown DB backend: " + options.Backend)
 }
 
-func AddGCMToken(app string, token string) {
-	gcmMemLock.Lock()
-	defer gcmMemLock.Unlock()
-	for _, element := range gcmTokens[app] {
-		if token == element {
-			log.Println("Token already registered: " + token + " for the app: " + app)
-			return
-		}
+// change is a value of a token modified in memory. kind is its bucket:
+// tokensBucket, timezonesBucket, tagsBucket or usersBucket.
+type change struct {
+	kind     string
+	platform string
+	app      string
+	token    string
+}
+
+// persister writes the changes of a memoryStore, each call in a single
+// transaction. It writes the values found in memory when committing, or
+// deletes them when they are gone: the writes may be committed in any
+// order, the last one stores the last values.
+type persister interface {
+	write(changes []change) error
+}
+
+// memoryStore indexes the tokens and their metadata in memory. Its changes
+// are handed to persist, when set.
+type memoryStore struct {
+	persist persister
+	// writeLock serializes the changes in memory, the operations made of
+	// several changes are applied at once.
+	writeLock sync.Mutex
+
+	tokens tokenIndex
+
+	timezonesLock sync.RWMutex
+	// timezones maps platform#app to the timezone of each token.
+	timezones map[string]map[string]string
+
+	tagsLock sync.RWMutex
+	// tokenTags maps platform#app to the tags of each token.
+	tokenTags map[string]map[string][]string
+	// tagIndex maps platform#app to the set of tokens carrying each tag.
+	tagIndex map[string]map[string]map[string]bool
+
+	usersLock sync.RWMutex
+	// tokenUsers maps platform#app to the user of each token.
+	tokenUsers map[string]map[string]string
+	// userDevices maps app to the devices of each user.
+	userDevices map[string]map[string]map[Device]bool
+
+	recordsLock sync.RWMutex
+	records     map[string]map[string][]byte
+}
+
+// NewMemoryStore returns an empty Store living in memory only.
+func NewMemoryStore() Store {
+	return newMemoryStore()
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		tokens:      newMemoryIndex(),
+		timezones:   make(map[string]map[string]string),
+		tokenTags:   make(map[string]map[string][]string),
+		tagIndex:    make(map[string]map[string]map[string]bool),
+		tokenUsers:  make(map[string]map[string]string),
+		userDevices: make(map[string]map[string]map[Device]bool),
+		records:     make(map[string]map[string][]byte),
 	}
-	gcmTokens[app] = append(gcmTokens[app], token)
-	log.Println("Token added: " + token + " for the app: " + app)
+}
 
-	saveTokenInDB("gcm", app, token)
+func (s *memoryStore) write(changes []change) error {
+	if s.persist == nil || len(changes) == 0 {
+		return nil
+	}
+	return s.persist.write(changes)
 }
 
-func RemoveGCMToken(app string, token string) {
-	gcmMemLock.Lock()
-	defer gcmMemLock.Unlock()
-	for i, element := range gcmTokens[app] {
-		if token == element {
-			gcmTokens[app] = append(gcmTokens[app][:i], gcmTokens[app][i+1:]...)
-			deleteTokenInDB("gcm", app, token)
-			log.Println("Token removed: " + token)
-			return
+// update applies changes in memory under the write lock, then persists
+// them. The writes of concurrent updates are committed together.
+func (s *memoryStore) update(apply func() []change) error {
+	s.writeLock.Lock()
+	changes := apply()
+	s.writeLock.Unlock()
+	return s.write(changes)
+}
+
+// value returns the current value of a change to write in tx, nil when it
+// was deleted, and false when there is nothing to write.
+func (s *memoryStore) value(tx *bolt.Tx, c change) ([]byte, bool) {
+	key := c.platform + "#" + c.app
+	switch c.kind {
+	case tokensBucket:
+		return s.tokens.value(tx, c.platform, c.app, c.token)
+	case timezonesBucket:
+		s.timezonesLock.RLock()
+		defer s.timezonesLock.RUnlock()
+		if timezone, ok := s.timezones[key][c.token]; ok {
+			return []byte(timezone), true
+		}
+	case tagsBucket:
+		s.tagsLock.RLock()
+		defer s.tagsLock.RUnlock()
+		if tags, ok := s.tokenTags[key][c.token]; ok {
+			return []byte(strings.Join(tags, ",")), true
+		}
+	case usersBucket:
+		s.usersLock.RLock()
+		defer s.usersLock.RUnlock()
+		if user, ok := s.tokenUsers[key][c.token]; ok {
+			return []byte(user), true
 		}
 	}
-	log.Println("No Token to remove: " + token)
+	return nil, true
+}
+
+func (s *memoryStore) GetTokens(platform string, app string) []string {
+	return s.tokens.snapshot(platform, app)
+}
+
+func (s *memoryStore) GetNbTokens(platform string, app string) int {
+	return s.tokens.count(platform, app)
 }
 
-func GetAPNSTokens(app string) []string {
-	apnsMemLock.RLock()
-	defer apnsMemLock.RUnlock()
-	return apnsTokens[app]
+func (s *memoryStore) HasToken(platform string, app string, token string) bool {
+	return s.tokens.has(platform, app, token)
 }
 
-func GetNbAPNSTokens(app string) int {
-	apnsMemLock.RLock()
-	defer apnsMemLock.RUnlock()
-	return len(apnsTokens[app])
+func (s *memoryStore) ForEachTokenPage(platform string, app string, size int, fn func(tokens []string) error) error {
+	if !ValidPlatform(platform) {
+		return nil
+	}
+	return s.tokens.forEachPage(platform, app, size, fn)
 }
 
-func AddAPNSToken(app string, token string) {
-	apnsMemLock.Lock()
-	defer apnsMemLock.Unlock()
-	for _, element := range apnsTokens[app] {
-		if token == element {
+func (s *memoryStore) AddToken(platform string, app string, token string) error {
+	return s.RegisterToken(platform, app, token, TokenInfo{})
+}
+
+func (s *memoryStore) RegisterToken(platform string, app string, token string, info TokenInfo) error {
+	return s.update(func() []change {
+		added, changes := s.registerToken(platform, app, token, info)
+		if added {
+			log.Println("Token added: " + token + " for the app: " + app)
+		} else if changes != nil {
 			log.Println("Token already registered: " + token + " for the app: " + app)
-			return
 		}
+		return changes
+	})
+}
+
+// registerToken reports whether the token was added.
+func (s *memoryStore) registerToken(platform string, app string, token string, info TokenInfo) (bool, []change) {
+	if !ValidPlatform(platform) {
+		return false, nil
 	}
-	apnsTokens[app] = append(apnsTokens[app], token)
-	log.Println("Token added: " + token + " for the app: " + app)
+	added := s.tokens.register(platform, app, token, info)
+	return added, []change{{tokensBucket, platform, app, token}}
+}
 
-	saveTokenInDB("apns", app, token)
+func (s *memoryStore) GetTokenInfo(platform string, app string, token string) (TokenInfo, bool) {
+	info, ok := s.tokens.info(platform, app, token)
+	if info == nil {
+		return TokenInfo{}, ok
+	}
+	return info.copy(), ok
 }
 
-func RemoveAPNSToken(app string, token string) {
-	apnsMemLock.Lock()
-	defer apnsMemLock.Unlock()
-	for i, element := range apnsTokens[app] {
-		if token == element {
-			apnsTokens[app] = append(apnsTokens[app][:i], apnsTokens[app][i+1:]...)
-			deleteTokenInDB("apns", app, token)
+func (s *memoryStore) RemoveToken(platform string, app string, token string) error {
+	return s.update(func() []change {
+		changes := s.removeToken(platform, app, token)
+		if changes == nil {
+			log.Println("No Token to remove: " + token)
+		} else {
 			log.Println("Token removed: " + token)
-			return
 		}
-	}
-	log.Println("No Token to remove: " + token)
+		return changes
+	})
 }
 
-func GetAPNSSandboxTokens(app string) []string {
-	apnsSandboxMemLock.RLock()
-	defer apnsSandboxMemLock.RUnlock()
-	return apnsSandboxTokens[app]
+func (s *memoryStore) removeToken(platform string, app string, token string) []change {
+	if !ValidPlatform(platform) || !s.tokens.remove(platform, app, token) {
+		return nil
+	}
+
+	changes := []change{{tokensBucket, platform, app, token}}
+	changes = append(changes, s.setTimezone(platform, app, token, "")...)
+	changes = append(changes, s.setTags(platform, app, token, nil)...)
+	changes = append(changes, s.setUser(platform, app, token, "")...)
+	return changes
 }
 
-func GetNbAPNSSandboxTokens(app string) int {
-	apnsSandboxMemLock.RLock()
-	defer apnsSandboxMemLock.RUnlock()
-	return len(apnsSandboxTokens[app])
+func (s *memoryStore) ReplaceToken(platform string, app string, oldToken string, newToken string) error {
+	if !ValidPlatform(platform) || oldToken == newToken {
+		return nil
+	}
+	return s.update(func() []change {
+		return s.replaceToken(platform, app, oldToken, newToken)
+	})
 }
 
-func AddAPNSSandboxToken(app string, token string) {
-	for _, element := range apnsSandboxTokens[app] {
-		if token == element {
-			log.Println("Token already registered: " + token + " for the app: " + app)
-			return
+func (s *memoryStore) CleanTokens(platform string, app string, removed []string, replaced map[string]string) error {
+	if !ValidPlatform(platform) {
+		return nil
+	}
+	return s.update(func() []change {
+		var changes []change
+		for _, token := range removed {
+			deleted := s.removeToken(platform, app, token)
+			if deleted != nil {
+				log.Println("Token removed: " + token)
+			}
+			changes = append(changes, deleted...)
+		}
+		for oldToken, newToken := range replaced {
+			if oldToken != newToken {
+				changes = append(changes, s.replaceToken(platform, app, oldToken, newToken)...)
+			}
 		}
+		return changes
+	})
+}
+
+// replaceToken moves a token and its timezone, tags and user to newToken,
+// the write lock must be held.
+func (s *memoryStore) replaceToken(platform string, app string, oldToken string, newToken string) []change {
+	// The readers see either token, never none.
+	if s.tokens.replace(platform, app, oldToken, newToken) {
+		log.Println("Token " + oldToken + " replaced by " + newToken + " for the app: " + app)
 	}
-	apnsSandboxTokens[app] = append(apnsSandboxTokens[app], token)
-	log.Println("Token added: " + token + " for the app: " + app)
 
-	saveTokenInDB("apnssandbox", app, token)
+	timezone := s.GetTokenTimezone(platform, app, oldToken)
+	tags := s.GetTokenTags(platform, app, oldToken)
+	user := s.GetTokenUser(platform, app, oldToken)
+	changes := []change{{tokensBucket, platform, app, oldToken}, {tokensBucket, platform, app, newToken}}
+	changes = append(changes, s.setTimezone(platform, app, oldToken, "")...)
+	changes = append(changes, s.setTags(platform, app, oldToken, nil)...)
+	changes = append(changes, s.setUser(platform, app, oldToken, "")...)
+	if timezone != "" {
+		changes = append(changes, s.setTimezone(platform, app, newToken, timezone)...)
+	}
+	if len(tags) > 0 {
+		changes = append(changes, s.setTags(platform, app, newToken, tags)...)
+	}
+	if user != "" {
+		changes = append(changes, s.setUser(platform, app, newToken, user)...)
+	}
+	return changes
 }
 
-func RemoveAPNSSandboxToken(app string, token string) {
-	for i, element := range apnsSandboxTokens[app] {
-		if token == element {
-			apnsSandboxTokens[app] = append(apnsSandboxTokens[app][:i], apnsSandboxTokens[app][i+1:]...)
-			deleteTokenInDB("apnssandbox", app, token)
-			log.Println("Token removed: " + token)
-			return
-		}
-	}
-	log.Println("No Token to remove: " + token)
-}
-
-func CreateBucket() *bolt.Bucket {
-    var bucket bolt.Bucket
-    err := db.Update(func(tx *bolt.Tx) error {
-        b, err := tx.CreateBucketIfNotExists([]byte("tokens"))
-        if err != nil {
-            return fmt.Errorf("create bucket: %s", err)
-        }
-        bucket = *b
-        return nil
-    })
-    if err != nil {
-        return nil
-    }
-    return &bucket
-}
-
-func InitCache() {
-	err := db.View(func(tx *bolt.Tx) error {
-        bucket := tx.Bucket([]byte("tokens"))
-        if bucket == nil {
-            bucket = CreateBucket();
-            if bucket == nil {
-                fmt.Errorf("Bucket not found!")
-            }
-        }
-
-        bucket.ForEach(func(k, v []byte) error {
-            res := strings.Split(string(k), "#")
-            if res[0] == "gcm" {
-                    gcmTokens[res[1]] = append(gcmTokens[res[1]], res[2])
-            } else if res[0] == "apns" {
-                    apnsTokens[res[1]] = append(apnsTokens[res[1]], res[2])
-            } else {
-                    apnsSandboxTokens[res[1]] = append(apnsSandboxTokens[res[1]], res[2])
-            }
-            return nil
-        })
-
-        return nil
-    })
-    if err != nil {
-    	panic(err)
-    }
-}
-
-func saveTokenInDB(plateform string, app string, token string) {
-    db.Update(func(tx *bolt.Tx) error {
-        b := tx.Bucket([]byte("tokens"))
-        err := b.Put([]byte(plateform + "#" + app + "#" + token), []byte(token))
-        return err
-    })
-}
-
-func deleteTokenInDB(plateform string, app string, token string) {
-    db.Update(func(tx *bolt.Tx) error {
-        b := tx.Bucket([]byte("tokens"))
-        err := b.Delete([]byte(plateform + "#" + app + "#" + token))
-        return err
-    })
+func (s *memoryStore) Close() error {
+	return nil
 }
@@ -1,63 +1,81 @@
 package dao
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"strconv"
-	"testing"
-	// "time"
+	"strings"
 	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
 )
 
+// openTestStore opens a bolt Store in a temporary directory.
+func openTestStore(t *testing.T) Store {
+	store, err := Open(filepath.Join(t.TempDir(), "broadcaster.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
 func TestGCMApi(t *testing.T) {
+	store := openTestStore(t)
 	app := "App1"
-	tokens1 := GetGCMTokens(app)
+	tokens1 := store.GetTokens(GCM, app)
 	if len(tokens1) != 0 {
 		t.Errorf("len(GetGCMTokens() = %v, want %v", len(tokens1), 0)
 	}
 
-	AddGCMToken(app, "123")
-	AddGCMToken(app, "456")
-	AddGCMToken(app, "789")
-	AddGCMToken(app, "100")
-	tokens2 := GetGCMTokens(app)
+	store.AddToken(GCM, app, "123")
+	store.AddToken(GCM, app, "456")
+	store.AddToken(GCM, app, "789")
+	store.AddToken(GCM, app, "100")
+	tokens2 := store.GetTokens(GCM, app)
 	if len(tokens2) != 4 {
 		t.Errorf("len(GetGCMTokens() = %v, want %v", len(tokens2), 4)
 	}
 
-	AddGCMToken(app, "123")
-	tokens21 := GetGCMTokens(app)
+	store.AddToken(GCM, app, "123")
+	tokens21 := store.GetTokens(GCM, app)
 	if len(tokens21) != 4 {
 		t.Errorf("len(GetGCMTokens() = %v, want %v", len(tokens21), 4)
 	}
 
-	RemoveGCMToken(app, "100")
-	tokens3 := GetGCMTokens(app)
+	store.RemoveToken(GCM, app, "100")
+	tokens3 := store.GetTokens(GCM, app)
 	if len(tokens3) != 3 {
 		t.Errorf("len(GetGCMTokens() = %v, want %v", len(tokens3), 3)
 	}
 
-	RemoveGCMToken(app, "111")
-	tokens4 := GetGCMTokens(app)
+	store.RemoveToken(GCM, app, "111")
+	tokens4 := store.GetTokens(GCM, app)
 	if len(tokens4) != 3 {
 		t.Errorf("len(GetGCMTokens() = %v, want %v", len(tokens4), 3)
 	}
 }
 
-func add(n int) {
-	AddGCMToken("App2", strconv.Itoa(n))
+func add(store Store, n int) {
+	store.AddToken(GCM, "App2", strconv.Itoa(n))
 }
 
-func remove(n int) {
-	RemoveGCMToken("App2", strconv.Itoa(n))
+func remove(store Store, n int) {
+	store.RemoveToken(GCM, "App2", strconv.Itoa(n))
 }
 
 func TestThreadsafe(t *testing.T) {
+	store := openTestStore(t)
 	MAX := 30000
 	var w sync.WaitGroup
 	w.Add(MAX)
 
 	for i := 1; i <= MAX; i++ {
 		go func(val int) {
-			add(val)
+			add(store, val)
 			w.Done()
 		}(i)
 
@@ -66,12 +84,538 @@ func TestThreadsafe(t *testing.T) {
 	// time.Sleep(30 * time.Second)
 	w.Wait()
 
-	tokens := GetGCMTokens("App2")
+	tokens := store.GetTokens(GCM, "App2")
 	if len(tokens) != 30000 {
 		t.Errorf("len(GetGCMTokens() = %v, want %v", len(tokens), 30000)
 	}
 
 	// for i := 1; i <= MAX; i++ {
-	// 	go remove(MAX - i)
+	// 	go remove(store, MAX - i)
 	// }
 }
+
+func TestRecords(t *testing.T) {
+	for _, store := range []Store{openTestStore(t), NewMemoryStore()} {
+		testRecords(t, store)
+	}
+}
+
+func testRecords(t *testing.T, store Store) {
+	store.PutRecord("test_records", "b", []byte("2"))
+	store.PutRecord("test_records", "a", []byte("1"))
+
+	value, err := store.GetRecord("test_records", "a")
+	if err != nil || string(value) != "1" {
+		t.Errorf("GetRecord() = %v, %v, want %v", string(value), err, "1")
+	}
+
+	var keys []string
+	store.ForEachRecord("test_records", func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 2 || keys[0] != "a" {
+		t.Errorf("ForEachRecord() keys = %v, want %v", keys, []string{"a", "b"})
+	}
+
+	store.DeleteRecord("test_records", "a")
+	value, _ = store.GetRecord("test_records", "a")
+	if value != nil {
+		t.Errorf("GetRecord() after delete = %v, want nil", value)
+	}
+	store.DeleteRecord("test_records", "b")
+}
+
+func TestUserDevices(t *testing.T) {
+	store := NewMemoryStore()
+	app := "UsersApp"
+	store.SetTokenUser(GCM, app, "g1", "42")
+	store.SetTokenUser(APNS, app, "a1", "42")
+	store.SetTokenUser(GCM, app, "g2", "7")
+
+	devices := store.GetUserDevices(app, "42")
+	if len(devices) != 2 || devices[0] != (Device{APNS, "a1"}) || devices[1] != (Device{GCM, "g1"}) {
+		t.Errorf("GetUserDevices() = %v, want the apns and gcm devices of 42", devices)
+	}
+
+	store.SetTokenUser(GCM, app, "g1", "7")
+	if devices := store.GetUserDevices(app, "7"); len(devices) != 2 {
+		t.Errorf("len(GetUserDevices()) after move = %v, want %v", len(devices), 2)
+	}
+
+	store.SetTokenUser(APNS, app, "a1", "")
+	if devices := store.GetUserDevices(app, "42"); len(devices) != 0 {
+		t.Errorf("GetUserDevices() after removal = %v, want none", devices)
+	}
+	store.SetTokenUser(GCM, app, "g1", "")
+	store.SetTokenUser(GCM, app, "g2", "")
+}
+
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcaster.db")
+	store, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.AddToken(APNS, "App3", "a1")
+	store.AddToken(APNS, "App3", "a2")
+	store.SetTokenTimezone(APNS, "App3", "a1", "Europe/Paris")
+	store.SetTokenTags(APNS, "App3", "a1", []string{"beta"})
+	store.SetTokenUser(APNS, "App3", "a1", "42")
+	store.RemoveToken(APNS, "App3", "a2")
+	store.Close()
+
+	if store, err = Open(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if tokens := store.GetTokens(APNS, "App3"); len(tokens) != 1 || tokens[0] != "a1" {
+		t.Errorf("GetTokens() after reopen = %v, want [a1]", tokens)
+	}
+	if timezone := store.GetTokenTimezone(APNS, "App3", "a1"); timezone != "Europe/Paris" {
+		t.Errorf("GetTokenTimezone() after reopen = %v, want Europe/Paris", timezone)
+	}
+	if tokens := store.GetTokensWithTag(APNS, "App3", "beta"); len(tokens) != 1 {
+		t.Errorf("GetTokensWithTag() after reopen = %v, want [a1]", tokens)
+	}
+	if devices := store.GetUserDevices("App3", "42"); len(devices) != 1 {
+		t.Errorf("GetUserDevices() after reopen = %v, want the device a1", devices)
+	}
+}
+
+func TestTokenInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcaster.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Older DBs store the token itself as value.
+	db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists([]byte("tokens"))
+		return b.Put([]byte("gcm#App4#legacy"), []byte("legacy"))
+	})
+	db.Close()
+
+	store, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, ok := store.GetTokenInfo(GCM, "App4", "legacy"); !ok || !info.FirstRegistered.IsZero() {
+		t.Errorf("GetTokenInfo() of a legacy token = %v, %v, want no metadata", info, ok)
+	}
+	store.RegisterToken(GCM, "App4", "legacy", TokenInfo{AppVersion: "1.2", Custom: map[string]string{"plan": "pro"}})
+	store.RegisterToken(GCM, "App4", "legacy", TokenInfo{Locale: "fr_FR"})
+	first, _ := store.GetTokenInfo(GCM, "App4", "legacy")
+	store.Close()
+
+	if store, err = Open(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	info, ok := store.GetTokenInfo(GCM, "App4", "legacy")
+	if !ok || info.AppVersion != "1.2" || info.Locale != "fr_FR" || info.Custom["plan"] != "pro" {
+		t.Errorf("GetTokenInfo() after reopen = %+v, want the merged metadata", info)
+	}
+	if !info.FirstRegistered.Equal(first.FirstRegistered) || info.LastRegistered.Before(info.FirstRegistered) {
+		t.Errorf("GetTokenInfo() registration times = %v, %v", info.FirstRegistered, info.LastRegistered)
+	}
+
+}
+
+func TestStampRegistrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcaster.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists([]byte("tokens"))
+		return b.Put([]byte("gcm#App6#legacy"), []byte("legacy"))
+	})
+	db.Close()
+
+	store, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.StampRegistrations("App6", []Device{{GCM, "legacy"}}, stamp); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if store, err = Open(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if info, _ := store.GetTokenInfo(GCM, "App6", "legacy"); !info.FirstRegistered.Equal(stamp) || !info.LastRegistered.Equal(stamp) {
+		t.Errorf("GetTokenInfo() of a stamped token = %+v, want %v", info, stamp)
+	}
+}
+
+func TestRemoveTokensIf(t *testing.T) {
+	store := NewMemoryStore()
+	old := time.Now().AddDate(0, 0, -30)
+	store.RegisterToken(GCM, "App7", "stale", TokenInfo{LastRegistered: old})
+	store.RegisterToken(GCM, "App7", "back", TokenInfo{LastRegistered: old})
+	cutoff := time.Now().AddDate(0, 0, -7)
+
+	// back registers again between the listing and the removal.
+	var devices []Device
+	store.ForEachToken(GCM, "App7", func(r Registration) error {
+		if r.Info.LastRegistered.Before(cutoff) {
+			devices = append(devices, Device{GCM, r.Token})
+		}
+		return nil
+	})
+	store.RegisterToken(GCM, "App7", "back", TokenInfo{})
+	removed, err := store.RemoveTokensIf("App7", devices, func(info TokenInfo) bool {
+		return info.LastRegistered.Before(cutoff)
+	})
+	if len(devices) != 2 || len(removed) != 2 || err != nil {
+		t.Fatalf("RemoveTokensIf() = %v, %v", removed, err)
+	}
+	if store.HasToken(GCM, "App7", "stale") || !store.HasToken(GCM, "App7", "back") {
+		t.Errorf("RemoveTokensIf() left %v, want back only", store.GetTokens(GCM, "App7"))
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcaster.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		tokens, _ := tx.CreateBucketIfNotExists([]byte("tokens"))
+		tokens.Put([]byte("gcm#a#b|c#tok"), []byte("tok"))
+		tokens.Put([]byte("broken"), []byte("broken"))
+		timezones, _ := tx.CreateBucketIfNotExists([]byte("timezones"))
+		return timezones.Put([]byte("gcm#a#b|c#tok"), []byte("Europe/Paris"))
+	})
+	db.Close()
+
+	for i := 0; i < 2; i++ {
+		report, err := Migrate(path, true, Options{})
+		if err != nil || report.From != 1 || report.To != SchemaVersion || report.Moved["tokens"] != 1 || report.Moved["timezones"] != 1 || len(report.Skipped) != 1 {
+			t.Fatalf("Migrate() dry run = %+v, %v", report, err)
+		}
+	}
+
+	if _, err := os.Stat(path + ".dry-run"); !os.IsNotExist(err) {
+		t.Errorf("Copy of the dry run left: %v", err)
+	}
+
+	store, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err := Migrate(path, true, Options{Timeout: 10 * time.Millisecond}); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Migrate() of a DB in use = %v, want an error", err)
+	}
+	if !store.HasToken(GCM, "a#b|c", "tok") || store.GetTokenTimezone(GCM, "a#b|c", "tok") != "Europe/Paris" {
+		t.Errorf("Token of the app a#b|c not migrated: %v", store.GetTokens(GCM, "a#b|c"))
+	}
+}
+
+func TestRegisterTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcaster.db")
+	store, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.AddToken(GCM, "App5", "g1")
+	added, err := store.RegisterTokens([]Registration{
+		{Platform: GCM, App: "App5", Token: "g1"},
+		{Platform: GCM, App: "App5", Token: "g2", Tags: []string{"beta"}, UserID: "42"},
+	})
+	if len(added) != 2 || added[0] || !added[1] || err != nil {
+		t.Errorf("RegisterTokens() = %v, %v, want g2 added", added, err)
+	}
+	if _, err := store.RegisterTokens([]Registration{{Platform: "web", App: "App5", Token: "w1"}}); err == nil {
+		t.Error("RegisterTokens() of an unknown platform should fail")
+	}
+	if _, err := store.RegisterTokens([]Registration{{Platform: GCM, App: "App5", Token: "g5", Tags: []string{"a,b"}}}); err == nil {
+		t.Error("RegisterTokens() of a tag holding a comma should fail")
+	}
+	store.AddToken(GCM, "App5", "g3")
+	if removed, err := store.RemoveTokens("App5", []Device{{GCM, "g3"}, {GCM, "g4"}}); len(removed) != 2 || !removed[0] || removed[1] || err != nil {
+		t.Errorf("RemoveTokens() = %v, %v, want g3 removed", removed, err)
+	}
+	store.Close()
+
+	if store, err = Open(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var regs []Registration
+	store.ForEachToken(GCM, "App5", func(r Registration) error {
+		regs = append(regs, r)
+		return nil
+	})
+	if len(regs) != 2 || store.GetTokenUser(GCM, "App5", "g2") != "42" {
+		t.Errorf("ForEachToken() after reopen = %v, want g1 and g2", regs)
+	}
+}
+
+func TestReplaceToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcaster.db")
+	store, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.RegisterToken(GCM, "App6", "old", TokenInfo{AppVersion: "2.0"})
+	store.SetTokenTimezone(GCM, "App6", "old", "Europe/Paris")
+	store.SetTokenTags(GCM, "App6", "old", []string{"beta"})
+	store.SetTokenUser(GCM, "App6", "old", "42")
+
+	// Concurrent writes are committed together.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			if err := store.AddToken(GCM, "App6", strconv.Itoa(n)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	if err := store.ReplaceToken(GCM, "App6", "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	store.Close()
+
+	if store, err = Open(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.HasToken(GCM, "App6", "old") || len(store.GetTokens(GCM, "App6")) != 21 {
+		t.Errorf("GetTokens() after reopen = %v, want new and 20 tokens", store.GetTokens(GCM, "App6"))
+	}
+	info, ok := store.GetTokenInfo(GCM, "App6", "new")
+	if !ok || info.AppVersion != "2.0" || store.GetTokenTimezone(GCM, "App6", "new") != "Europe/Paris" ||
+		len(store.GetTokenTags(GCM, "App6", "new")) != 1 || store.GetTokenUser(GCM, "App6", "new") != "42" {
+		t.Errorf("ReplaceToken() did not move the metadata of old: %+v", info)
+	}
+	if store.GetTokenUser(GCM, "App6", "old") != "" || len(store.GetUserDevices("App6", "42")) != 1 {
+		t.Errorf("GetUserDevices() after ReplaceToken() = %v, want new", store.GetUserDevices("App6", "42"))
+	}
+}
+
+func TestCleanTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcaster.db")
+	// A write alone does not wait for others to commit with.
+	store, err := Open(path, Options{BatchDelay: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1 := time.Now()
+	for i := 0; i < 5; i++ {
+		store.AddToken(GCM, "App8", strconv.Itoa(i))
+	}
+	store.SetTokenTags(GCM, "App8", "3", []string{"beta"})
+	if d := time.Since(t1); d > time.Second {
+		t.Errorf("6 sequential writes took %v, want no batch delay", d)
+	}
+	if err := store.CleanTokens(GCM, "App8", []string{"0", "1", "unknown"}, map[string]string{"3": "30"}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	if store, err = Open(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.GetNbTokens(GCM, "App8") != 3 || store.HasToken(GCM, "App8", "0") || store.HasToken(GCM, "App8", "3") {
+		t.Errorf("GetTokens() after CleanTokens() = %v, want 2, 30 and 4", store.GetTokens(GCM, "App8"))
+	}
+	if tags := store.GetTokenTags(GCM, "App8", "30"); len(tags) != 1 {
+		t.Errorf("GetTokenTags(30) = %v, want the tags of 3", tags)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(filepath.Join(dir, "broadcaster.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.AddToken(GCM, "App7", "g1")
+	store.SetTokenTags(GCM, "App7", "g1", []string{"beta"})
+	store.AddToken(APNS, "App7", "a1")
+
+	snapshot, err := os.Create(filepath.Join(dir, "snapshot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Backup(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Close()
+
+	if _, err := Restore(snapshot.Name(), filepath.Join(dir, "broadcaster.db"), Options{Timeout: 10 * time.Millisecond}); err == nil {
+		t.Error("Restore() of a DB in use should fail")
+	}
+	path := filepath.Join(dir, "restored.db")
+	report, err := Restore(snapshot.Name(), path, Options{})
+	if err != nil || report.SchemaVersion != SchemaVersion || report.Tokens[GCM] != 1 || report.Tokens[APNS] != 1 {
+		t.Fatalf("Restore() = %+v, %v", report, err)
+	}
+	restored, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if tokens := restored.GetTokensWithTag(GCM, "App7", "beta"); len(tokens) != 1 {
+		t.Errorf("GetTokensWithTag() after restore = %v, want [g1]", tokens)
+	}
+
+	os.WriteFile(snapshot.Name(), []byte("not a DB"), 0600)
+	if _, err := Restore(snapshot.Name(), path, Options{}); err == nil {
+		t.Error("Restore() of an invalid snapshot should fail")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcaster.db")
+	key := bytes.Repeat([]byte{1}, EncryptionKeySize)
+	store, err := Open(path, Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.RegisterToken(GCM, "App8", "secret-token", TokenInfo{DeviceModel: "Pixel"})
+	store.SetTokenTimezone(GCM, "App8", "secret-token", "Europe/Paris")
+	store.SetTokenUser(GCM, "App8", "secret-token", "secret-user")
+	store.PutRecord("jobs", "j1", []byte("secret-record"))
+	store.AddToken(GCM, "App8", "removed-token")
+	store.RemoveToken(GCM, "App8", "removed-token")
+	store.Close()
+
+	data, _ := os.ReadFile(path)
+	for _, secret := range []string{"secret-token", "secret-user", "secret-record", "Pixel"} {
+		if bytes.Contains(data, []byte(secret)) {
+			t.Errorf("The DB holds %s in plaintext", secret)
+		}
+	}
+	if _, err := Open(path, Options{}); err == nil {
+		t.Error("Open() of an encrypted DB without key should fail")
+	}
+	if _, err := Open(path, Options{EncryptionKey: bytes.Repeat([]byte{2}, EncryptionKeySize)}); err == nil {
+		t.Error("Open() with another key should fail")
+	}
+
+	newKey := bytes.Repeat([]byte{3}, EncryptionKeySize)
+	if report, err := RotateKey(path, Options{EncryptionKey: key}, newKey); err != nil || report.Tokens != 1 || report.Records != 1 {
+		t.Fatalf("RotateKey() = %+v, %v", report, err)
+	}
+	if store, err = Open(path, Options{EncryptionKey: newKey}); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := store.GetTokenInfo(GCM, "App8", "secret-token")
+	record, _ := store.GetRecord("jobs", "j1")
+	if tokens := store.GetTokens(GCM, "App8"); len(tokens) != 1 || info.DeviceModel != "Pixel" || string(record) != "secret-record" ||
+		store.GetTokenTimezone(GCM, "App8", "secret-token") != "Europe/Paris" || store.GetTokenUser(GCM, "App8", "secret-token") != "secret-user" {
+		t.Errorf("DB after RotateKey() = %v, %+v, %s", tokens, info, record)
+	}
+	store.Close()
+
+	if _, err := RotateKey(path, Options{EncryptionKey: newKey}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, Options{EncryptionKey: key}); err == nil {
+		t.Error("Open() of a plaintext DB with a key should fail")
+	}
+	if store, err = Open(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if !store.HasToken(GCM, "App8", "secret-token") {
+		t.Error("Token lost by the decryption")
+	}
+}
+
+func TestLazy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broadcaster.db")
+	key := bytes.Repeat([]byte{4}, EncryptionKeySize)
+	store, err := Open(path, Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		store.AddToken(GCM, "App9", "g"+strconv.Itoa(i))
+	}
+	store.SetTokenTags(GCM, "App9", "g1", []string{"beta"})
+	store.Close()
+
+	if store, err = Open(path, Options{EncryptionKey: key, Lazy: true}); err != nil {
+		t.Fatal(err)
+	}
+	if n := store.GetNbTokens(GCM, "App9"); n != 25 {
+		t.Errorf("GetNbTokens() = %v, want 25", n)
+	}
+	var wg sync.WaitGroup
+	for i := 25; i < 50; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			store.RegisterToken(GCM, "App9", "g"+strconv.Itoa(n), TokenInfo{Locale: "fr_FR"})
+		}(i)
+	}
+	wg.Wait()
+	store.RemoveToken(GCM, "App9", "g0")
+	store.ReplaceToken(GCM, "App9", "g1", "g1b")
+	if !store.HasToken(GCM, "App9", "g1b") || store.HasToken(GCM, "App9", "g1") || store.HasToken(GCM, "App9", "g0") {
+		t.Error("HasToken() does not see the changes")
+	}
+	if info, ok := store.GetTokenInfo(GCM, "App9", "g30"); !ok || info.Locale != "fr_FR" {
+		t.Errorf("GetTokenInfo() = %+v, %v", info, ok)
+	}
+
+	pages := 0
+	seen := make(map[string]bool)
+	store.ForEachTokenPage(GCM, "App9", 10, func(tokens []string) error {
+		pages++
+		for _, token := range tokens {
+			seen[token] = true
+			// The iteration may change the tokens.
+			if token == "g2" {
+				store.RemoveToken(GCM, "App9", token)
+			}
+		}
+		return nil
+	})
+	if pages != 5 || len(seen) != 49 || !seen["g1b"] {
+		t.Errorf("ForEachTokenPage() = %v tokens in %v pages, want 49 in 5", len(seen), pages)
+	}
+	if n := store.GetNbTokens(GCM, "App9"); n != 48 {
+		t.Errorf("GetNbTokens() = %v, want 48", n)
+	}
+
+	store.SetTokenTimezone(GCM, "App9", "g30", "Europe/Paris")
+	if timezones := store.GetTimezones(GCM, "App9"); len(timezones) != 2 || timezones[0] != "" || timezones[1] != "Europe/Paris" {
+		t.Errorf("GetTimezones() = %v, want [ Europe/Paris]", timezones)
+	}
+	regs := make(map[string]Registration)
+	store.ForEachToken(GCM, "App9", func(r Registration) error {
+		regs[r.Token] = r
+		return nil
+	})
+	if len(regs) != 48 || regs["g30"].Info.Locale != "fr_FR" || regs["g30"].Timezone != "Europe/Paris" || len(regs["g1b"].Tags) != 1 {
+		t.Errorf("ForEachToken() = %v tokens, g30 %+v", len(regs), regs["g30"])
+	}
+	store.Close()
+
+	if store, err = Open(path, Options{EncryptionKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if n := len(store.GetTokens(GCM, "App9")); n != 48 || !store.HasToken(GCM, "App9", "g1b") {
+		t.Errorf("GetTokens() after a lazy run = %v tokens, want 48", n)
+	}
+	if tags := store.GetTokenTags(GCM, "App9", "g1b"); len(tags) != 1 {
+		t.Errorf("GetTokenTags() of the replaced token = %v, want [beta]", tags)
+	}
+}
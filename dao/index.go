@@ -0,0 +1,215 @@
+package dao
+
+import (
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// tokenIndex holds the tokens of every platform and app with their
+// metadata. Its methods are safe for concurrent use, the changes are
+// serialized by the write lock of the store.
+type tokenIndex interface {
+	has(platform string, app string, token string) bool
+	count(platform string, app string) int
+	// info returns the metadata of a token, nil for a token registered
+	// without, and false when the token is not registered.
+	info(platform string, app string, token string) (*TokenInfo, bool)
+	// infos maps the registered tokens among tokens to their metadata.
+	infos(platform string, app string, tokens []string) map[string]*TokenInfo
+	// register adds a token or merges info in its metadata, and reports
+	// whether it was added.
+	register(platform string, app string, token string, info TokenInfo) bool
+	remove(platform string, app string, token string) bool
+	// replace moves oldToken and its metadata to newToken at once, and
+	// reports whether oldToken was registered.
+	replace(platform string, app string, oldToken string, newToken string) bool
+	apps(platform string) []string
+	// snapshot returns the tokens of an app, see Store.GetTokens.
+	snapshot(platform string, app string) []string
+	// forEachPage calls fn with the tokens of an app, size at a time.
+	forEachPage(platform string, app string, size int, fn func(tokens []string) error) error
+	// value returns the value of a token to write in tx, nil when it was
+	// removed, and false when there is nothing to write.
+	value(tx *bolt.Tx, platform string, app string, token string) ([]byte, bool)
+}
+
+// memoryIndex keeps the tokens of each platform in memory.
+type memoryIndex map[string]*platformTokens
+
+// platformTokens holds the tokens of one platform and their metadata, per
+// app.
+type platformTokens struct {
+	// lock is taken for writing by the snapshots too, they mark the set
+	// as shared.
+	lock  sync.RWMutex
+	apps  map[string]*tokenSet
+	infos map[string]map[string]*TokenInfo
+}
+
+func newPlatformTokens() *platformTokens {
+	return &platformTokens{apps: make(map[string]*tokenSet), infos: make(map[string]map[string]*TokenInfo)}
+}
+
+func newMemoryIndex() memoryIndex {
+	return memoryIndex{
+		GCM:         newPlatformTokens(),
+		APNS:        newPlatformTokens(),
+		APNSSandbox: newPlatformTokens(),
+		WebPush:     newPlatformTokens(),
+		HMS:         newPlatformTokens(),
+		ADM:         newPlatformTokens(),
+	}
+}
+
+func (m memoryIndex) has(platform string, app string, token string) bool {
+	p := m[platform]
+	if p == nil {
+		return false
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.apps[app] != nil && p.apps[app].contains(token)
+}
+
+func (m memoryIndex) count(platform string, app string) int {
+	p := m[platform]
+	if p == nil {
+		return 0
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.apps[app] == nil {
+		return 0
+	}
+	return p.apps[app].len()
+}
+
+func (m memoryIndex) info(platform string, app string, token string) (*TokenInfo, bool) {
+	p := m[platform]
+	if p == nil {
+		return nil, false
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.apps[app] == nil || !p.apps[app].contains(token) {
+		return nil, false
+	}
+	return p.infos[app][token], true
+}
+
+func (m memoryIndex) infos(platform string, app string, tokens []string) map[string]*TokenInfo {
+	infos := make(map[string]*TokenInfo, len(tokens))
+	p := m[platform]
+	if p == nil {
+		return infos
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.apps[app] == nil {
+		return infos
+	}
+	for _, token := range tokens {
+		if p.apps[app].contains(token) {
+			infos[token] = p.infos[app][token]
+		}
+	}
+	return infos
+}
+
+func (m memoryIndex) register(platform string, app string, token string, info TokenInfo) bool {
+	p := m[platform]
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	added := p.add(app, token, nil)
+	p.infos[app][token] = p.infos[app][token].merge(info, time.Now())
+	return added
+}
+
+func (m memoryIndex) remove(platform string, app string, token string) bool {
+	p := m[platform]
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	removed := p.apps[app] != nil && p.apps[app].remove(token)
+	if removed {
+		delete(p.infos[app], token)
+	}
+	return removed
+}
+
+func (m memoryIndex) replace(platform string, app string, oldToken string, newToken string) bool {
+	p := m[platform]
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	info := p.infos[app][oldToken]
+	replaced := p.apps[app] != nil && p.apps[app].remove(oldToken)
+	delete(p.infos[app], oldToken)
+	if info == nil {
+		info = p.infos[app][newToken].merge(TokenInfo{}, time.Now())
+	}
+	p.add(app, newToken, info)
+	return replaced
+}
+
+func (m memoryIndex) apps(platform string) []string {
+	p := m[platform]
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	var apps []string
+	for app := range p.apps {
+		apps = append(apps, app)
+	}
+	return apps
+}
+
+func (m memoryIndex) snapshot(platform string, app string) []string {
+	p := m[platform]
+	if p == nil {
+		return nil
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.apps[app] == nil {
+		return nil
+	}
+	return p.apps[app].snapshot()
+}
+
+func (m memoryIndex) forEachPage(platform string, app string, size int, fn func(tokens []string) error) error {
+	tokens := m.snapshot(platform, app)
+	for i := 0; i < len(tokens); i += size {
+		end := i + size
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		if err := fn(tokens[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m memoryIndex) value(tx *bolt.Tx, platform string, app string, token string) ([]byte, bool) {
+	info, ok := m.info(platform, app, token)
+	switch {
+	case !ok:
+		return nil, true
+	case info == nil:
+		return (&TokenInfo{}).encode(), true
+	}
+	return info.encode(), true
+}
+
+// add inserts a token of an app and sets its metadata when info is not
+// nil, the lock must be held.
+func (p *platformTokens) add(app string, token string, info *TokenInfo) bool {
+	if p.apps[app] == nil {
+		p.apps[app] = newTokenSet()
+		p.infos[app] = make(map[string]*TokenInfo)
+	}
+	if info != nil {
+		p.infos[app][token] = info
+	}
+	return p.apps[app].add(token)
+}
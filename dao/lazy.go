@@ -0,0 +1,252 @@
+package dao
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// lazyIndex reads the tokens from the bolt DB instead of keeping them in
+// memory. The changes not committed yet are kept in pending, the reads
+// look them up first. An entry is dropped once the transaction writing it
+// commits, unless a later change replaced it.
+type lazyIndex struct {
+	s *boltStore
+
+	lock sync.RWMutex
+	// pending maps the tokens changed to their metadata, nil when they
+	// were removed.
+	pending map[tokenKey]*TokenInfo
+}
+
+type tokenKey struct {
+	platform string
+	app      string
+	token    string
+}
+
+func newLazyIndex(s *boltStore) *lazyIndex {
+	return &lazyIndex{s: s, pending: make(map[tokenKey]*TokenInfo)}
+}
+
+// get returns the metadata of a token, the lock must be held.
+func (l *lazyIndex) get(k tokenKey) (*TokenInfo, bool) {
+	if info, ok := l.pending[k]; ok {
+		return info, info != nil
+	}
+	var info *TokenInfo
+	found := false
+	err := l.s.db.View(func(tx *bolt.Tx) error {
+		b, _ := tokenBucket(tx, tokensBucket, k.platform, k.app, false)
+		if b == nil {
+			return nil
+		}
+		key := l.s.crypt.lookup(k.token)
+		value := b.Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+		_, value, err := l.s.open(tx, tokensBucket, k.platform, k.app, key, value)
+		info, found = decodeTokenInfo(value), err == nil
+		return err
+	})
+	if err != nil {
+		log.Println("Token " + k.token + " not read: " + err.Error())
+	}
+	return info, found
+}
+
+func (l *lazyIndex) has(platform string, app string, token string) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	_, ok := l.get(tokenKey{platform, app, token})
+	return ok
+}
+
+// count reads the number of tokens stored, the changes being written are
+// not counted yet.
+func (l *lazyIndex) count(platform string, app string) int {
+	count := 0
+	l.s.db.View(func(tx *bolt.Tx) error {
+		count = tokenCount(tx, platform, app)
+		return nil
+	})
+	return count
+}
+
+func (l *lazyIndex) info(platform string, app string, token string) (*TokenInfo, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.get(tokenKey{platform, app, token})
+}
+
+// infos reads the metadata of a page of tokens in a single transaction.
+func (l *lazyIndex) infos(platform string, app string, tokens []string) map[string]*TokenInfo {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	infos := make(map[string]*TokenInfo, len(tokens))
+	err := l.s.db.View(func(tx *bolt.Tx) error {
+		b, _ := tokenBucket(tx, tokensBucket, platform, app, false)
+		for _, token := range tokens {
+			if info, ok := l.pending[tokenKey{platform, app, token}]; ok {
+				if info != nil {
+					infos[token] = info
+				}
+				continue
+			}
+			if b == nil {
+				continue
+			}
+			key := l.s.crypt.lookup(token)
+			value := b.Get([]byte(key))
+			if value == nil {
+				continue
+			}
+			_, value, err := l.s.open(tx, tokensBucket, platform, app, key, value)
+			if err != nil {
+				return err
+			}
+			infos[token] = decodeTokenInfo(value)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Tokens of " + platform + "#" + app + " not read: " + err.Error())
+	}
+	return infos
+}
+
+func (l *lazyIndex) register(platform string, app string, token string, info TokenInfo) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	k := tokenKey{platform, app, token}
+	current, found := l.get(k)
+	l.pending[k] = current.merge(info, time.Now())
+	return !found
+}
+
+func (l *lazyIndex) remove(platform string, app string, token string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	k := tokenKey{platform, app, token}
+	if _, found := l.get(k); !found {
+		return false
+	}
+	l.pending[k] = nil
+	return true
+}
+
+func (l *lazyIndex) replace(platform string, app string, oldToken string, newToken string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	info, replaced := l.get(tokenKey{platform, app, oldToken})
+	if replaced {
+		l.pending[tokenKey{platform, app, oldToken}] = nil
+	}
+	if info == nil {
+		current, _ := l.get(tokenKey{platform, app, newToken})
+		info = current.merge(TokenInfo{}, time.Now())
+	}
+	l.pending[tokenKey{platform, app, newToken}] = info
+	return replaced
+}
+
+func (l *lazyIndex) apps(platform string) []string {
+	var apps []string
+	l.s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(appsBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(app, v []byte) error {
+			if b.Bucket(app) != nil && b.Bucket(app).Bucket([]byte(platform)) != nil {
+				apps = append(apps, string(app))
+			}
+			return nil
+		})
+	})
+	return apps
+}
+
+func (l *lazyIndex) snapshot(platform string, app string) []string {
+	var tokens []string
+	l.forEachPage(platform, app, tokenPageSize, func(page []string) error {
+		tokens = append(tokens, page...)
+		return nil
+	})
+	return tokens
+}
+
+// forEachPage reads each page in its own transaction with a cursor, fn may
+// change the tokens.
+func (l *lazyIndex) forEachPage(platform string, app string, size int, fn func(tokens []string) error) error {
+	var last []byte
+	for {
+		var page []string
+		err := l.s.db.View(func(tx *bolt.Tx) error {
+			b, _ := tokenBucket(tx, tokensBucket, platform, app, false)
+			if b == nil {
+				return nil
+			}
+			c := b.Cursor()
+			k, v := c.First()
+			if last != nil {
+				if k, v = c.Seek(last); k != nil && string(k) == string(last) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(page) < size; k, v = c.Next() {
+				token, _, err := l.s.open(tx, tokensBucket, platform, app, string(k), v)
+				if err != nil {
+					return err
+				}
+				page = append(page, token)
+				last = append(last[:0], k...)
+			}
+			return nil
+		})
+		if err != nil || len(page) == 0 {
+			return err
+		}
+
+		// Skip the tokens removed but not written yet.
+		l.lock.RLock()
+		tokens := page[:0]
+		for _, token := range page {
+			if info, ok := l.pending[tokenKey{platform, app, token}]; !ok || info != nil {
+				tokens = append(tokens, token)
+			}
+		}
+		l.lock.RUnlock()
+		if len(tokens) == 0 {
+			continue
+		}
+		if err := fn(tokens); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *lazyIndex) value(tx *bolt.Tx, platform string, app string, token string) ([]byte, bool) {
+	k := tokenKey{platform, app, token}
+	l.lock.RLock()
+	info, ok := l.pending[k]
+	l.lock.RUnlock()
+	if !ok {
+		// Written by an earlier transaction.
+		return nil, false
+	}
+	tx.OnCommit(func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		if current, ok := l.pending[k]; ok && current == info {
+			delete(l.pending, k)
+		}
+	})
+	if info == nil {
+		return nil, true
+	}
+	return info.encode(), true
+}
@@ -0,0 +1,54 @@
+package dao
+
+import (
+	"sort"
+)
+
+// Records are opaque values stored by key in their own bucket, next to the
+// tokens. They hold the broadcast jobs and other server state.
+
+func (s *memoryStore) PutRecord(bucket string, key string, value []byte) error {
+	s.recordsLock.Lock()
+	defer s.recordsLock.Unlock()
+	if s.records[bucket] == nil {
+		s.records[bucket] = make(map[string][]byte)
+	}
+	s.records[bucket][key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *memoryStore) GetRecord(bucket string, key string) ([]byte, error) {
+	s.recordsLock.RLock()
+	defer s.recordsLock.RUnlock()
+	if value, ok := s.records[bucket][key]; ok {
+		return append([]byte(nil), value...), nil
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) DeleteRecord(bucket string, key string) error {
+	s.recordsLock.Lock()
+	defer s.recordsLock.Unlock()
+	delete(s.records[bucket], key)
+	return nil
+}
+
+// ForEachRecord works on a copy of the bucket, fn may change the records.
+func (s *memoryStore) ForEachRecord(bucket string, fn func(key string, value []byte) error) error {
+	s.recordsLock.RLock()
+	keys := make([]string, 0, len(s.records[bucket]))
+	values := make(map[string][]byte, len(s.records[bucket]))
+	for key, value := range s.records[bucket] {
+		keys = append(keys, key)
+		values[key] = value
+	}
+	s.recordsLock.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key, values[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
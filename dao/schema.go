@@ -0,0 +1,276 @@
+package dao
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// Layout of the bolt DB, schema version 3:
+//
+//	meta/schema_version = "3"
+//	apps/<app>/<platform>/count = number of tokens
+//	apps/<app>/<platform>/tokens/<token> = TokenInfo
+//	apps/<app>/<platform>/timezones/<token> = timezone
+//	apps/<app>/<platform>/tags/<token> = comma separated tags
+//	apps/<app>/<platform>/users/<token> = user
+//	<records bucket>/<key> = record
+//
+// Version 1 kept the tokens and their metadata in the top level tokens,
+// timezones, tags and users buckets under platform#app#token keys. A DB
+// without meta bucket is a version 1 DB. Version 2 had no count.
+//
+// An encrypted DB stores the tokens under their lookup key, see crypt.go.
+
+// SchemaVersion is the version of the layout written by this package.
+const SchemaVersion = 3
+
+const (
+	metaBucket       = "meta"
+	appsBucket       = "apps"
+	schemaVersionKey = "schema_version"
+	countKey         = "count"
+)
+
+// tokenKinds are the buckets of an app and platform.
+var tokenKinds = []string{tokensBucket, timezonesBucket, tagsBucket, usersBucket}
+
+// MigrationReport describes the changes of a migration.
+type MigrationReport struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+	// Moved counts the values moved, per bucket.
+	Moved map[string]int `json:"moved,omitempty"`
+	// Skipped lists the keys that could not be migrated.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// migrations[v] migrates a DB from version v to version v+1.
+var migrations = map[int]func(tx *bolt.Tx, report *MigrationReport) error{
+	1: migrateFlatBuckets,
+	2: countTokens,
+}
+
+// Migrate brings the DB at path to SchemaVersion. With dryRun the DB is
+// opened read-only and the migration runs on a temporary copy, the report
+// tells what would change. Both fail after options.Timeout when the DB is
+// in use.
+func Migrate(path string, dryRun bool, options Options) (MigrationReport, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: dryRun, Timeout: options.Timeout})
+	if err == bolt.ErrTimeout {
+		return MigrationReport{}, errors.New("The DB " + path + " is in use, stop the server before migrating")
+	}
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	defer db.Close()
+
+	if dryRun {
+		copied, err := copyDB(db, path+".dry-run")
+		if err != nil {
+			return MigrationReport{}, err
+		}
+		defer os.Remove(copied.Path())
+		defer copied.Close()
+		db = copied
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	report, err := migrate(tx)
+	if err != nil || dryRun {
+		tx.Rollback()
+		return report, err
+	}
+	return report, tx.Commit()
+}
+
+// copyDB writes the content of db to path and opens the copy.
+func copyDB(db *bolt.DB, path string) (*bolt.DB, error) {
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return bolt.Open(path, 0600, nil)
+}
+
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	meta := tx.Bucket([]byte(metaBucket))
+	if meta == nil {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(string(meta.Get([]byte(schemaVersionKey))))
+	if err != nil {
+		return 0, errors.New("Invalid schema version: " + string(meta.Get([]byte(schemaVersionKey))))
+	}
+	return version, nil
+}
+
+// migrate runs the migrations needed by the DB of tx.
+func migrate(tx *bolt.Tx) (MigrationReport, error) {
+	version, err := schemaVersion(tx)
+	report := MigrationReport{From: version, To: version, Moved: make(map[string]int)}
+	if err != nil {
+		return report, err
+	}
+	if version > SchemaVersion {
+		return report, errors.New("The DB schema version " + strconv.Itoa(version) + " is newer than the supported version " + strconv.Itoa(SchemaVersion))
+	}
+
+	for ; version < SchemaVersion; version++ {
+		if err := migrations[version](tx, &report); err != nil {
+			return report, err
+		}
+	}
+	report.To = version
+
+	meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return report, err
+	}
+	return report, meta.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(SchemaVersion)))
+}
+
+// migrateFlatBuckets moves the platform#app#token keys of version 1 to the
+// buckets of their app and platform. The app is everything between the
+// first and the last #, app names may contain one.
+func migrateFlatBuckets(tx *bolt.Tx, report *MigrationReport) error {
+	for _, kind := range tokenKinds {
+		flat := tx.Bucket([]byte(kind))
+		if flat == nil {
+			continue
+		}
+		err := flat.ForEach(func(k, v []byte) error {
+			key := string(k)
+			first := strings.Index(key, "#")
+			last := strings.LastIndex(key, "#")
+			if first <= 0 || last <= first+1 || last == len(key)-1 {
+				report.Skipped = append(report.Skipped, kind+"/"+key)
+				return nil
+			}
+			b, err := tokenBucket(tx, kind, key[:first], key[first+1:last], true)
+			if err != nil {
+				return err
+			}
+			report.Moved[kind]++
+			return b.Put([]byte(key[last+1:]), v)
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket([]byte(kind)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countTokens stores the number of tokens of each app and platform.
+func countTokens(tx *bolt.Tx, report *MigrationReport) error {
+	apps := tx.Bucket([]byte(appsBucket))
+	if apps == nil {
+		return nil
+	}
+	return apps.ForEach(func(app, v []byte) error {
+		return apps.Bucket(app).ForEach(func(platform, v []byte) error {
+			count := 0
+			if tokens, _ := tokenBucket(tx, tokensBucket, string(platform), string(app), false); tokens != nil {
+				tokens.ForEach(func(k, v []byte) error {
+					count++
+					return nil
+				})
+			}
+			return apps.Bucket(app).Bucket(platform).Put([]byte(countKey), []byte(strconv.Itoa(count)))
+		})
+	})
+}
+
+// tokenCount returns the number of tokens of an app and platform.
+func tokenCount(tx *bolt.Tx, platform string, app string) int {
+	b := tx.Bucket([]byte(appsBucket))
+	for _, name := range []string{app, platform} {
+		if b == nil {
+			return 0
+		}
+		b = b.Bucket([]byte(name))
+	}
+	if b == nil {
+		return 0
+	}
+	count, _ := strconv.Atoi(string(b.Get([]byte(countKey))))
+	return count
+}
+
+// addTokenCount adds delta to the number of tokens of an app and platform,
+// whose bucket must exist.
+func addTokenCount(tx *bolt.Tx, platform string, app string, delta int) error {
+	count := tokenCount(tx, platform, app) + delta
+	b := tx.Bucket([]byte(appsBucket)).Bucket([]byte(app)).Bucket([]byte(platform))
+	return b.Put([]byte(countKey), []byte(strconv.Itoa(count)))
+}
+
+// tokenBucket returns the kind bucket of an app and platform, nil when it
+// does not exist and create is false.
+func tokenBucket(tx *bolt.Tx, kind string, platform string, app string, create bool) (*bolt.Bucket, error) {
+	if !create {
+		b := tx.Bucket([]byte(appsBucket))
+		for _, name := range []string{app, platform, kind} {
+			if b == nil {
+				return nil, nil
+			}
+			b = b.Bucket([]byte(name))
+		}
+		return b, nil
+	}
+
+	b, err := tx.CreateBucketIfNotExists([]byte(appsBucket))
+	for _, name := range []string{app, platform, kind} {
+		if err != nil {
+			return nil, err
+		}
+		b, err = b.CreateBucketIfNotExists([]byte(name))
+	}
+	return b, err
+}
+
+// forEachToken calls fn for every value of the kind buckets of every app
+// and platform.
+func forEachToken(tx *bolt.Tx, fn func(kind string, platform string, app string, token string, value []byte) error) error {
+	apps := tx.Bucket([]byte(appsBucket))
+	if apps == nil {
+		return nil
+	}
+	return apps.ForEach(func(app, v []byte) error {
+		appBucket := apps.Bucket(app)
+		if appBucket == nil {
+			return nil
+		}
+		return appBucket.ForEach(func(platform, v []byte) error {
+			platformBucket := appBucket.Bucket(platform)
+			if platformBucket == nil {
+				return nil
+			}
+			for _, kind := range tokenKinds {
+				b := platformBucket.Bucket([]byte(kind))
+				if b == nil {
+					continue
+				}
+				err := b.ForEach(func(token, value []byte) error {
+					return fn(kind, string(platform), string(app), string(token), value)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package dao
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The tags of each device, kept in the "tags" bucket of its app and
+// platform, and indexed by tag in memory.
+
+const tagsBucket = "tags"
+
+// CheckTags returns an error for the tags that cannot be stored: the tags
+// of a token are stored comma separated, a tag holding a comma would come
+// back split in two.
+func CheckTags(tags []string) error {
+	for _, tag := range tags {
+		if strings.Contains(tag, ",") {
+			return errors.New("Invalid tag " + strconv.Quote(tag) + ": tags cannot contain a comma")
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SetTokenTags(platform string, app string, token string, tags []string) error {
+	if err := CheckTags(tags); err != nil {
+		return err
+	}
+	return s.update(func() []change {
+		return s.setTags(platform, app, token, tags)
+	})
+}
+
+func (s *memoryStore) setTags(platform string, app string, token string, tags []string) []change {
+	tags = normalizeTags(tags)
+
+	s.tagsLock.Lock()
+	defer s.tagsLock.Unlock()
+	key := platform + "#" + app
+	if strings.Join(s.tokenTags[key][token], ",") == strings.Join(tags, ",") {
+		return nil
+	}
+	s.setTokenTagsInMem(key, token, tags)
+	return []change{{tagsBucket, platform, app, token}}
+}
+
+func (s *memoryStore) GetTokenTags(platform string, app string, token string) []string {
+	s.tagsLock.RLock()
+	defer s.tagsLock.RUnlock()
+	return s.tokenTags[platform+"#"+app][token]
+}
+
+func (s *memoryStore) GetTokensWithTag(platform string, app string, tag string) []string {
+	s.tagsLock.RLock()
+	defer s.tagsLock.RUnlock()
+	set := s.tagIndex[platform+"#"+app][strings.ToLower(tag)]
+	tokens := make([]string, 0, len(set))
+	for token := range set {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// normalizeTags lowercases, trims, sorts and dedupes tags.
+func normalizeTags(tags []string) []string {
+	seen := make(map[string]bool)
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+func (s *memoryStore) setTokenTagsInMem(key string, token string, tags []string) {
+	for _, tag := range s.tokenTags[key][token] {
+		delete(s.tagIndex[key][tag], token)
+		if len(s.tagIndex[key][tag]) == 0 {
+			delete(s.tagIndex[key], tag)
+		}
+	}
+	if len(tags) == 0 {
+		delete(s.tokenTags[key], token)
+		return
+	}
+
+	if s.tokenTags[key] == nil {
+		s.tokenTags[key] = make(map[string][]string)
+		s.tagIndex[key] = make(map[string]map[string]bool)
+	}
+	s.tokenTags[key][token] = tags
+	for _, tag := range tags {
+		if s.tagIndex[key][tag] == nil {
+			s.tagIndex[key][tag] = make(map[string]bool)
+		}
+		s.tagIndex[key][tag][token] = true
+	}
+}
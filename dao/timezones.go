@@ -0,0 +1,65 @@
+package dao
+
+import (
+	"sort"
+)
+
+// The IANA timezone of each device, when the app registered it, kept in
+// the "timezones" bucket of its app and platform.
+
+const timezonesBucket = "timezones"
+
+func (s *memoryStore) SetTokenTimezone(platform string, app string, token string, timezone string) error {
+	return s.update(func() []change {
+		return s.setTimezone(platform, app, token, timezone)
+	})
+}
+
+func (s *memoryStore) setTimezone(platform string, app string, token string, timezone string) []change {
+	s.timezonesLock.Lock()
+	defer s.timezonesLock.Unlock()
+	if !s.setTimezoneInMem(platform+"#"+app, token, timezone) {
+		return nil
+	}
+	return []change{{timezonesBucket, platform, app, token}}
+}
+
+func (s *memoryStore) GetTokenTimezone(platform string, app string, token string) string {
+	s.timezonesLock.RLock()
+	defer s.timezonesLock.RUnlock()
+	return s.timezones[platform+"#"+app][token]
+}
+
+func (s *memoryStore) GetTimezones(platform string, app string) []string {
+	found := make(map[string]bool)
+	s.ForEachTokenPage(platform, app, tokenPageSize, func(tokens []string) error {
+		s.timezonesLock.RLock()
+		defer s.timezonesLock.RUnlock()
+		for _, token := range tokens {
+			found[s.timezones[platform+"#"+app][token]] = true
+		}
+		return nil
+	})
+	timezones := make([]string, 0, len(found))
+	for timezone := range found {
+		timezones = append(timezones, timezone)
+	}
+	sort.Strings(timezones)
+	return timezones
+}
+
+// setTimezoneInMem reports whether the timezone of the token changed.
+func (s *memoryStore) setTimezoneInMem(key string, token string, timezone string) bool {
+	if s.timezones[key][token] == timezone {
+		return false
+	}
+	if timezone == "" {
+		delete(s.timezones[key], token)
+		return true
+	}
+	if s.timezones[key] == nil {
+		s.timezones[key] = make(map[string]string)
+	}
+	s.timezones[key][token] = timezone
+	return true
+}
@@ -0,0 +1,93 @@
+package dao
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// TokenInfo is the metadata of a registered device. It is stored JSON
+// encoded as the value of the token in the "tokens" bucket. The first DBs
+// held the token itself there, their tokens have no metadata.
+type TokenInfo struct {
+	FirstRegistered time.Time         `json:"first_registered"`
+	LastRegistered  time.Time         `json:"last_registered"`
+	AppVersion      string            `json:"app_version,omitempty"`
+	OSVersion       string            `json:"os_version,omitempty"`
+	Locale          string            `json:"locale,omitempty"`
+	DeviceModel     string            `json:"device_model,omitempty"`
+	Custom          map[string]string `json:"custom,omitempty"`
+}
+
+// merge returns the metadata of a registration of a device previously
+// known by info, which may be nil. The fields of update replace the
+// previous ones when set, an empty custom value deletes its key. The
+// registration times default to now.
+func (info *TokenInfo) merge(update TokenInfo, now time.Time) *TokenInfo {
+	merged := &TokenInfo{}
+	if info != nil {
+		*merged = info.copy()
+	}
+
+	if merged.FirstRegistered.IsZero() {
+		merged.FirstRegistered = update.FirstRegistered
+		if merged.FirstRegistered.IsZero() {
+			merged.FirstRegistered = now
+		}
+	}
+	merged.LastRegistered = update.LastRegistered
+	if merged.LastRegistered.IsZero() {
+		merged.LastRegistered = now
+	}
+	if update.AppVersion != "" {
+		merged.AppVersion = update.AppVersion
+	}
+	if update.OSVersion != "" {
+		merged.OSVersion = update.OSVersion
+	}
+	if update.Locale != "" {
+		merged.Locale = update.Locale
+	}
+	if update.DeviceModel != "" {
+		merged.DeviceModel = update.DeviceModel
+	}
+	for key, value := range update.Custom {
+		if value == "" {
+			delete(merged.Custom, key)
+			continue
+		}
+		if merged.Custom == nil {
+			merged.Custom = make(map[string]string)
+		}
+		merged.Custom[key] = value
+	}
+	return merged
+}
+
+func (info TokenInfo) copy() TokenInfo {
+	if info.Custom != nil {
+		custom := make(map[string]string, len(info.Custom))
+		for key, value := range info.Custom {
+			custom[key] = value
+		}
+		info.Custom = custom
+	}
+	return info
+}
+
+func (info *TokenInfo) encode() []byte {
+	data, _ := json.Marshal(info)
+	return data
+}
+
+// decodeTokenInfo reads the value of a token, nil for the bare tokens of
+// older DBs.
+func decodeTokenInfo(value []byte) *TokenInfo {
+	if len(value) == 0 || value[0] != '{' {
+		return nil
+	}
+	info := &TokenInfo{}
+	if err := json.Unmarshal(value, info); err != nil {
+		return nil
+	}
+	return info
+}
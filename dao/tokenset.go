@@ -0,0 +1,104 @@
+package dao
+
+// tokenSet is a set of tokens with O(1) add, remove and contains. The
+// tokens are kept in a slice, in no particular order, so that the send
+// paths can iterate over a snapshot without copying it.
+//
+// A token removed while the slice is shared by a snapshot leaves a
+// tombstone: its slot keeps the token, which is dropped from the index
+// only. The next snapshot, or too many tombstones, compact the slice into
+// a new one, the snapshots keep the old one.
+type tokenSet struct {
+	index  map[string]int
+	tokens []string
+	// shared is set once the slice was handed out by snapshot: its
+	// elements must not be overwritten until it is compacted.
+	shared bool
+	// dead counts the tombstones of tokens, only left while shared.
+	dead int
+}
+
+func newTokenSet() *tokenSet {
+	return &tokenSet{index: make(map[string]int)}
+}
+
+func (s *tokenSet) len() int {
+	return len(s.tokens) - s.dead
+}
+
+func (s *tokenSet) contains(token string) bool {
+	_, ok := s.index[token]
+	return ok
+}
+
+// add inserts a token and reports whether it was missing.
+func (s *tokenSet) add(token string) bool {
+	if _, ok := s.index[token]; ok {
+		return false
+	}
+	// Snapshots are capped to their length, appending never touches them.
+	s.index[token] = len(s.tokens)
+	s.tokens = append(s.tokens, token)
+	return true
+}
+
+// remove deletes a token and reports whether it was present. The last
+// token is moved into its slot, unless the slice is shared.
+func (s *tokenSet) remove(token string) bool {
+	i, ok := s.index[token]
+	if !ok {
+		return false
+	}
+	delete(s.index, token)
+
+	if s.shared {
+		s.dead++
+		// Compacting once half the slots are dead keeps removals O(1)
+		// amortized and bounds the memory of the tombstones.
+		if s.dead > len(s.tokens)/2 {
+			s.compact()
+		}
+		return true
+	}
+
+	last := len(s.tokens) - 1
+	if i != last {
+		s.tokens[i] = s.tokens[last]
+		s.index[s.tokens[i]] = i
+	}
+	s.tokens[last] = ""
+	s.tokens = s.tokens[:last]
+	return true
+}
+
+// live reports whether the slot i holds a token of the set, not a
+// tombstone.
+func (s *tokenSet) live(i int) bool {
+	j, ok := s.index[s.tokens[i]]
+	return ok && i == j
+}
+
+// compact copies the tokens of the set to a new slice without the
+// tombstones.
+func (s *tokenSet) compact() {
+	tokens := make([]string, 0, len(s.tokens)-s.dead)
+	for i, token := range s.tokens {
+		if s.live(i) {
+			s.index[token] = len(tokens)
+			tokens = append(tokens, token)
+		}
+	}
+	s.tokens = tokens
+	s.shared = false
+	s.dead = 0
+}
+
+// snapshot returns the current tokens. The slice is never modified
+// afterwards, it can be read without holding any lock.
+func (s *tokenSet) snapshot() []string {
+	if s.dead > 0 {
+		s.compact()
+	}
+	s.shared = true
+	return s.tokens[:len(s.tokens):len(s.tokens)]
+}
@@ -0,0 +1,123 @@
+package dao
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestTokenSet(t *testing.T) {
+	s := newTokenSet()
+	for i := 0; i < 10; i++ {
+		if !s.add("token" + strconv.Itoa(i)) {
+			t.Fatal("token" + strconv.Itoa(i) + " not added")
+		}
+	}
+	if s.add("token3") {
+		t.Error("token3 added twice")
+	}
+
+	snapshot := s.snapshot()
+	if !s.remove("token3") || s.remove("token3") {
+		t.Error("token3 should be removed once")
+	}
+	s.add("token10")
+	if s.contains("token3") || !s.contains("token9") || !s.contains("token10") || s.len() != 10 {
+		t.Errorf("Unexpected tokens after removal: %v", s.tokens)
+	}
+	if len(snapshot) != 10 || snapshot[3] != "token3" {
+		t.Errorf("Snapshot modified by the set: %v", snapshot)
+	}
+
+	// The next snapshot drops the tombstone of token3.
+	next := s.snapshot()
+	if len(next) != 10 || s.dead != 0 {
+		t.Errorf("Unexpected snapshot after removal: %v", next)
+	}
+	for _, token := range next {
+		if token == "token3" {
+			t.Error("token3 in the snapshot after its removal")
+		}
+	}
+	if len(snapshot) != 10 || snapshot[3] != "token3" {
+		t.Errorf("Snapshot modified by the compaction: %v", snapshot)
+	}
+
+	for i, token := range s.tokens {
+		if s.index[token] != i {
+			t.Errorf("Index of %s is %d instead of %d", token, s.index[token], i)
+		}
+	}
+}
+
+var benchmarkSizes = []int{10000, 1000000, 10000000}
+
+func benchmarkSet(size int) *tokenSet {
+	s := newTokenSet()
+	for i := 0; i < size; i++ {
+		s.add("token" + strconv.Itoa(i))
+	}
+	return s
+}
+
+// The benchmarks run on sets of up to 10M tokens, the time per operation
+// must not grow with the size of the set.
+func BenchmarkTokenSet(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		s := benchmarkSet(size)
+		b.Run("Add/"+strconv.Itoa(size), func(b *testing.B) {
+			extra := make([]string, 0, b.N)
+			for i := 0; i < b.N; i++ {
+				extra = append(extra, "extra"+strconv.Itoa(i))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s.add(extra[i])
+			}
+			b.StopTimer()
+			for _, token := range extra {
+				s.remove(token)
+			}
+		})
+		b.Run("Contains/"+strconv.Itoa(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.contains(s.tokens[i%size])
+			}
+		})
+		b.Run("Remove/"+strconv.Itoa(size), func(b *testing.B) {
+			removed := make([]string, 0, b.N)
+			for i := 0; i < b.N && i < size; i++ {
+				removed = append(removed, s.tokens[(i*7919)%s.len()])
+			}
+			b.ResetTimer()
+			for _, token := range removed {
+				s.remove(token)
+			}
+			b.StopTimer()
+			for _, token := range removed {
+				s.add(token)
+			}
+		})
+		// Every broadcast snapshots the set before the rejected tokens are
+		// removed.
+		b.Run("RemoveAfterSnapshot/"+strconv.Itoa(size), func(b *testing.B) {
+			removed := make([]string, 0, b.N)
+			for i := 0; i < b.N && i < size; i++ {
+				removed = append(removed, s.tokens[(i*7919)%s.len()])
+			}
+			s.snapshot()
+			b.ResetTimer()
+			for _, token := range removed {
+				s.remove(token)
+			}
+			b.StopTimer()
+			for _, token := range removed {
+				s.add(token)
+			}
+		})
+		b.Run("Snapshot/"+strconv.Itoa(size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.snapshot()
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package dao
+
+import (
+	"sort"
+)
+
+// The user owning each device, kept in the "users" bucket of its app and
+// platform, and indexed by user in memory so that every device of a user
+// can be reached across platforms.
+
+const usersBucket = "users"
+
+// Device is a registered token and its platform.
+type Device struct {
+	Platform string `json:"platform"`
+	Token    string `json:"token"`
+}
+
+func (s *memoryStore) SetTokenUser(platform string, app string, token string, user string) error {
+	return s.update(func() []change {
+		return s.setUser(platform, app, token, user)
+	})
+}
+
+func (s *memoryStore) setUser(platform string, app string, token string, user string) []change {
+	s.usersLock.Lock()
+	defer s.usersLock.Unlock()
+	if s.tokenUsers[platform+"#"+app][token] == user {
+		return nil
+	}
+	s.setTokenUserInMem(platform, app, token, user)
+	return []change{{usersBucket, platform, app, token}}
+}
+
+func (s *memoryStore) GetTokenUser(platform string, app string, token string) string {
+	s.usersLock.RLock()
+	defer s.usersLock.RUnlock()
+	return s.tokenUsers[platform+"#"+app][token]
+}
+
+func (s *memoryStore) GetUserDevices(app string, user string) []Device {
+	s.usersLock.RLock()
+	defer s.usersLock.RUnlock()
+	devices := []Device{}
+	for device := range s.userDevices[app][user] {
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(a, b int) bool {
+		if devices[a].Platform != devices[b].Platform {
+			return devices[a].Platform < devices[b].Platform
+		}
+		return devices[a].Token < devices[b].Token
+	})
+	return devices
+}
+
+func (s *memoryStore) setTokenUserInMem(platform string, app string, token string, user string) {
+	key := platform + "#" + app
+	device := Device{platform, token}
+	if previous, ok := s.tokenUsers[key][token]; ok {
+		delete(s.userDevices[app][previous], device)
+		if len(s.userDevices[app][previous]) == 0 {
+			delete(s.userDevices[app], previous)
+		}
+	}
+	if user == "" {
+		delete(s.tokenUsers[key], token)
+		return
+	}
+
+	if s.tokenUsers[key] == nil {
+		s.tokenUsers[key] = make(map[string]string)
+	}
+	if s.userDevices[app] == nil {
+		s.userDevices[app] = make(map[string]map[Device]bool)
+	}
+	if s.userDevices[app][user] == nil {
+		s.userDevices[app][user] = make(map[Device]bool)
+	}
+	s.tokenUsers[key][token] = user
+	s.userDevices[app][user][device] = true
+}
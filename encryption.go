@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"mobile-push-broadcaster/dao"
+)
+
+// encryptionKeyEnv holds the base64 encryption key of the DB, it takes
+// precedence over the encryption_key_file setting.
+const encryptionKeyEnv = "BROADCASTER_ENCRYPTION_KEY"
+
+// encryptionKey returns the key encrypting the DB, nil when it is in
+// plaintext. A key is 32 random bytes in base64, generated with
+//
+//	head -c 32 /dev/urandom | base64
+func encryptionKey() ([]byte, error) {
+	if key := os.Getenv(encryptionKeyEnv); key != "" {
+		return decodeKey(key, encryptionKeyEnv)
+	}
+	if settings.DatabaseKeyFile == "" {
+		return nil, nil
+	}
+	return readKeyFile(settings.DatabaseKeyFile)
+}
+
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(string(data), path)
+}
+
+func decodeKey(encoded string, source string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != dao.EncryptionKeySize {
+		return nil, errors.New("The encryption key of " + source + " must be 32 bytes in base64")
+	}
+	return key, nil
+}
+
+// storeOptions are the options of the DB configured by the database
+// settings.
+func storeOptions() (dao.Options, error) {
+	key, err := encryptionKey()
+	return dao.Options{Backend: settings.DatabaseBackend, Timeout: 5 * time.Second, EncryptionKey: key, Lazy: settings.LazyTokens}, err
+}
+
+// rotateKeyCommand encrypts the DB with a new key, or decrypts it. The
+// current key is the configured one, none for a DB in plaintext. Once
+// done, the new key must replace the current one in the settings.
+func rotateKeyCommand(args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	newKeyFile := flags.String("new-key-file", "", "file of the new base64 key")
+	decrypt := flags.Bool("decrypt", false, "store the DB in plaintext")
+	if err := commandFlags(flags, args); err != nil {
+		return err
+	}
+	if (*newKeyFile == "") == !*decrypt {
+		return errors.New("Either -new-key-file or -decrypt is required")
+	}
+	if settings.DatabaseBackend == dao.MemoryBackend {
+		return errors.New("The memory backend has no DB to encrypt")
+	}
+
+	options, err := storeOptions()
+	if err != nil {
+		return err
+	}
+	var newKey []byte
+	if *newKeyFile != "" {
+		if newKey, err = readKeyFile(*newKeyFile); err != nil {
+			return err
+		}
+	}
+	report, err := dao.RotateKey(databasePath(), options, newKey)
+	if err != nil {
+		return err
+	}
+	state := "in plaintext"
+	if report.Encrypted {
+		state = "encrypted with the new key"
+	}
+	fmt.Printf("%d tokens and %d records %s, update the encryption key setting before starting the server\n", report.Tokens, report.Records, state)
+	return nil
+}
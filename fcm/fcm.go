@@ -0,0 +1,297 @@
+// Package fcm sends Android notifications through the FCM HTTP v1 API.
+//
+// Every app authenticates with its own Google service account. The sender
+// mints OAuth2 access tokens from the account key, caches them until shortly
+// before they expire and sends one message per registration token.
+package fcm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"mobile-push-broadcaster/oauth"
+	"mobile-push-broadcaster/pool"
+)
+
+const (
+	DefaultEndpoint = "https://fcm.googleapis.com"
+	DefaultTokenURL = "https://oauth2.googleapis.com/token"
+
+	messagingScope = "https://www.googleapis.com/auth/firebase.messaging"
+	maxRetries     = 2
+)
+
+// ServiceAccount holds the fields of a Google service-account JSON file
+// needed to mint access tokens.
+type ServiceAccount struct {
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// LoadServiceAccount reads a service-account JSON file.
+func LoadServiceAccount(path string) (*ServiceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseServiceAccount(data)
+}
+
+// ParseServiceAccount decodes the content of a service-account JSON file.
+func ParseServiceAccount(data []byte) (*ServiceAccount, error) {
+	var account ServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("fcm: parsing service account: %v", err)
+	}
+	if account.ProjectID == "" || account.ClientEmail == "" || account.PrivateKey == "" {
+		return nil, errors.New("fcm: service account needs project_id, client_email and private_key")
+	}
+	return &account, nil
+}
+
+// Result is the outcome of the message sent to one registration token.
+type Result struct {
+	Token     string
+	MessageID string
+	// Status is the FCM error code (UNREGISTERED, INVALID_ARGUMENT...) or
+	// empty when the message was accepted.
+	Status string
+	Err    error
+}
+
+// Unregistered reports whether FCM rejected the token itself, meaning it
+// should be removed from the store. INVALID_ARGUMENT is a failure only, FCM
+// also answers it for an invalid payload, which would remove every token.
+func (r Result) Unregistered() bool {
+	return r.Status == "UNREGISTERED" || r.Status == "SENDER_ID_MISMATCH"
+}
+
+// Sender sends messages for one Firebase project.
+type Sender struct {
+	Account *ServiceAccount
+	// Endpoint is the FCM API root, DefaultEndpoint when empty.
+	Endpoint string
+	// TokenURL is the OAuth2 token endpoint. When empty the token_uri of
+	// the service account is used, then DefaultTokenURL.
+	TokenURL string
+	Client   *http.Client
+	// Workers is the number of messages sent concurrently.
+	Workers int
+
+	key    *rsa.PrivateKey
+	tokens oauth.TokenSource
+}
+
+// NewSender returns a sender authenticating with the given account.
+func NewSender(account *ServiceAccount) (*Sender, error) {
+	key, err := parsePrivateKey(account.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{Account: account, key: key}, nil
+}
+
+func parsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("fcm: private_key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+			return rsaKey, nil
+		}
+		return nil, errors.New("fcm: private_key is not an RSA key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("fcm: parsing private_key: %v", err)
+	}
+	return key, nil
+}
+
+// Send sends data to every token concurrently and returns one result per
+// token, in the order of tokens.
+func (s *Sender) Send(data map[string]string, tokens []string) []Result {
+	results := make([]Result, len(tokens))
+	pool.Run(len(tokens), s.Workers, func(i int) {
+		results[i] = s.SendOne(data, tokens[i])
+	})
+	return results
+}
+
+// SendOne sends data to a single token, retrying transient failures.
+func (s *Sender) SendOne(data map[string]string, token string) Result {
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token": token,
+			"data":  data,
+		},
+	})
+	if err != nil {
+		return Result{Token: token, Err: err}
+	}
+
+	var result Result
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+		}
+		var retry bool
+		result, retry = s.post(token, body)
+		if !retry {
+			break
+		}
+	}
+	return result
+}
+
+func (s *Sender) post(token string, body []byte) (Result, bool) {
+	result := Result{Token: token}
+
+	accessToken, err := s.AccessToken()
+	if err != nil {
+		result.Err = err
+		return result, true
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(endpoint, "/")+"/v1/projects/"+s.Account.ProjectID+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		result.Err = err
+		return result, false
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		result.Err = err
+		return result, true
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusOK {
+		var sent struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(respBody, &sent)
+		result.MessageID = sent.Name
+		return result, false
+	}
+
+	result.Status = errorCode(respBody)
+	result.Err = fmt.Errorf("fcm: %s (HTTP %d)", result.Status, resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		s.tokens.Reset()
+		return result, true
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return result, true
+	}
+	return result, false
+}
+
+// errorCode extracts the FCM error code from an error response, falling
+// back to the generic Google API status.
+func errorCode(body []byte) string {
+	var resp struct {
+		Error struct {
+			Status  string `json:"status"`
+			Details []struct {
+				Type      string `json:"@type"`
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "UNKNOWN"
+	}
+	for _, detail := range resp.Error.Details {
+		if detail.ErrorCode != "" {
+			return detail.ErrorCode
+		}
+	}
+	if resp.Error.Status != "" {
+		return resp.Error.Status
+	}
+	return "UNKNOWN"
+}
+
+func (s *Sender) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+func (s *Sender) tokenURL() string {
+	if s.TokenURL != "" {
+		return s.TokenURL
+	}
+	if s.Account.TokenURI != "" {
+		return s.Account.TokenURI
+	}
+	return DefaultTokenURL
+}
+
+// AccessToken returns a cached OAuth2 access token, minting a new one when
+// the cached token is missing or about to expire.
+func (s *Sender) AccessToken() (string, error) {
+	return s.tokens.Token(func() (string, time.Duration, error) {
+		assertion, err := s.assertion(time.Now())
+		if err != nil {
+			return "", 0, err
+		}
+		form := url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		}
+		token, lifetime, err := oauth.RequestToken(s.Client, s.tokenURL(), form)
+		if err != nil {
+			return "", 0, fmt.Errorf("fcm: %v", err)
+		}
+		return token, lifetime, nil
+	})
+}
+
+// assertion builds the RS256-signed JWT exchanged for an access token.
+func (s *Sender) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.Account.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   s.Account.ClientEmail,
+		"scope": messagingScope,
+		"aud":   s.tokenURL(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("fcm: signing assertion: %v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,100 @@
+package fcm
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func testAccount(t *testing.T) *ServiceAccount {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	return &ServiceAccount{
+		ProjectID:   "project",
+		ClientEmail: "sender@project.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	}
+}
+
+func TestSend(t *testing.T) {
+	var tokenRequests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenRequests, 1)
+		if r.PostFormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || strings.Count(r.PostFormValue("assertion"), ".") != 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token":"access","expires_in":3600}`))
+	})
+	mux.HandleFunc("/v1/projects/project/messages:send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body struct {
+			Message struct {
+				Token string            `json:"token"`
+				Data  map[string]string `json:"data"`
+			} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Message.Data["from"] != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"code":400,"status":"INVALID_ARGUMENT","message":"Invalid data payload key: from"}}`))
+			return
+		}
+		if body.Message.Token == "dead" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`))
+			return
+		}
+		w.Write([]byte(`{"name":"projects/project/messages/` + body.Message.Data["title"] + `"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sender, err := NewSender(testAccount(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.Endpoint = server.URL
+	sender.TokenURL = server.URL + "/token"
+
+	results := sender.Send(map[string]string{"title": "hello"}, []string{"a", "dead", "b"})
+	if len(results) != 3 {
+		t.Fatalf("len(results) = %v, want %v", len(results), 3)
+	}
+	if results[0].Err != nil || results[0].MessageID != "projects/project/messages/hello" {
+		t.Errorf("results[0] = %+v, want a sent message", results[0])
+	}
+	if !results[1].Unregistered() || results[1].Token != "dead" {
+		t.Errorf("results[1] = %+v, want an UNREGISTERED token", results[1])
+	}
+	if results[2].Err != nil {
+		t.Errorf("results[2].Err = %v, want nil", results[2].Err)
+	}
+
+	sender.Send(map[string]string{"title": "again"}, []string{"c"})
+	if n := atomic.LoadInt32(&tokenRequests); n != 1 {
+		t.Errorf("token requests = %v, want %v", n, 1)
+	}
+
+	// A payload error fails every token without removing them.
+	results = sender.Send(map[string]string{"from": "reserved"}, []string{"a", "b"})
+	for _, result := range results {
+		if result.Err == nil || result.Status != "INVALID_ARGUMENT" || result.Unregistered() {
+			t.Errorf("result = %+v, want a failed but registered token", result)
+		}
+	}
+}
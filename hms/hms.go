@@ -0,0 +1,235 @@
+// Package hms sends Android notifications to the Huawei devices through the
+// HMS Push Kit server API.
+//
+// Every app authenticates with the OAuth client credentials of its
+// AppGallery Connect project. The sender caches the access token until
+// shortly before it expires and sends one request per batch of tokens.
+package hms
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"mobile-push-broadcaster/oauth"
+)
+
+const (
+	DefaultEndpoint = "https://push-api.cloud.huawei.com"
+	DefaultTokenURL = "https://oauth-login.cloud.huawei.com/oauth2/v3/token"
+
+	// MaxTokens is the number of tokens of one request.
+	MaxTokens  = 1000
+	maxRetries = 2
+)
+
+// Result codes of the Push Kit API.
+const (
+	CodeSuccess        = "80000000"
+	CodePartialSuccess = "80100000"
+	CodeTokenExpired   = "80200003"
+	CodeInvalidTokens  = "80300007"
+	CodeInternalError  = "81000001"
+)
+
+// Result is the outcome of the message sent to one token.
+type Result struct {
+	Token string
+	// Code is the Push Kit result code of the request of the token.
+	Code string
+	Err  error
+	// Invalid is set when Push Kit reported the token as illegal.
+	Invalid bool
+}
+
+// Unregistered reports whether Push Kit rejected the token itself, meaning
+// it should be removed from the store.
+func (r Result) Unregistered() bool {
+	return r.Invalid
+}
+
+// Sender sends messages for one Push Kit app.
+type Sender struct {
+	AppID     string
+	AppSecret string
+	// Endpoint is the Push Kit API root, DefaultEndpoint when empty.
+	Endpoint string
+	// TokenURL is the OAuth2 token endpoint, DefaultTokenURL when empty.
+	TokenURL string
+	Client   *http.Client
+
+	tokens oauth.TokenSource
+}
+
+// NewSender returns a sender authenticating with the client credentials of
+// an app.
+func NewSender(appID string, appSecret string) *Sender {
+	return &Sender{AppID: appID, AppSecret: appSecret}
+}
+
+// response is the body of the answers of Push Kit.
+type response struct {
+	Code      string `json:"code"`
+	Msg       string `json:"msg"`
+	RequestID string `json:"requestId"`
+}
+
+// Send sends data as a data message to every token and returns one result
+// per token, in the order of tokens.
+func (s *Sender) Send(data map[string]string, tokens []string) []Result {
+	results := make([]Result, 0, len(tokens))
+	for i := 0; i < len(tokens); i += MaxTokens {
+		max := i + MaxTokens
+		if max > len(tokens) {
+			max = len(tokens)
+		}
+		results = append(results, s.sendBatch(data, tokens[i:max])...)
+	}
+	return results
+}
+
+// sendBatch sends one request, retrying transient failures.
+func (s *Sender) sendBatch(data map[string]string, tokens []string) []Result {
+	payload, err := json.Marshal(data)
+	var body []byte
+	if err == nil {
+		body, err = json.Marshal(map[string]interface{}{
+			"validate_only": false,
+			"message": map[string]interface{}{
+				"data":  string(payload),
+				"token": tokens,
+			},
+		})
+	}
+	if err != nil {
+		return failed(tokens, "", err)
+	}
+
+	var results []Result
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+		}
+		var retry bool
+		results, retry = s.post(tokens, body)
+		if !retry {
+			break
+		}
+	}
+	return results
+}
+
+func (s *Sender) post(tokens []string, body []byte) ([]Result, bool) {
+	accessToken, err := s.AccessToken()
+	if err != nil {
+		return failed(tokens, "", err), true
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(endpoint, "/")+"/v1/"+url.PathEscape(s.AppID)+"/messages:send", bytes.NewReader(body))
+	if err != nil {
+		return failed(tokens, "", err), false
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return failed(tokens, "", err), true
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+
+	var sent response
+	json.Unmarshal(respBody, &sent)
+	switch {
+	case sent.Code == CodeSuccess:
+		return failed(tokens, sent.Code, nil), false
+	case sent.Code == CodePartialSuccess:
+		return partial(tokens, sent), false
+	case sent.Code == CodeInvalidTokens:
+		results := failed(tokens, sent.Code, fmt.Errorf("hms: illegal token (%s)", sent.Code))
+		for i := range results {
+			results[i].Invalid = true
+		}
+		return results, false
+	}
+
+	err = fmt.Errorf("hms: %s %s (HTTP %d)", sent.Code, sent.Msg, resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized, sent.Code == CodeTokenExpired:
+		s.tokens.Reset()
+		return failed(tokens, sent.Code, err), true
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500, sent.Code == CodeInternalError:
+		return failed(tokens, sent.Code, err), true
+	}
+	return failed(tokens, sent.Code, err), false
+}
+
+// partial returns the results of a partial success, whose msg lists the
+// illegal tokens.
+func partial(tokens []string, sent response) []Result {
+	var msg struct {
+		IllegalTokens []string `json:"illegal_tokens"`
+	}
+	json.Unmarshal([]byte(sent.Msg), &msg)
+	illegal := make(map[string]bool)
+	for _, token := range msg.IllegalTokens {
+		illegal[token] = true
+	}
+
+	results := failed(tokens, sent.Code, nil)
+	for i, token := range tokens {
+		if illegal[token] {
+			results[i].Err = fmt.Errorf("hms: illegal token (%s)", sent.Code)
+			results[i].Invalid = true
+		}
+	}
+	return results
+}
+
+// failed returns the same result for every token.
+func failed(tokens []string, code string, err error) []Result {
+	results := make([]Result, len(tokens))
+	for i, token := range tokens {
+		results[i] = Result{Token: token, Code: code, Err: err}
+	}
+	return results
+}
+
+func (s *Sender) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+// AccessToken returns a cached OAuth2 access token, requesting a new one
+// with the client credentials when the cached token is missing or about to
+// expire.
+func (s *Sender) AccessToken() (string, error) {
+	return s.tokens.Token(func() (string, time.Duration, error) {
+		tokenURL := s.TokenURL
+		if tokenURL == "" {
+			tokenURL = DefaultTokenURL
+		}
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {s.AppID},
+			"client_secret": {s.AppSecret},
+		}
+		token, lifetime, err := oauth.RequestToken(s.Client, tokenURL, form)
+		if err != nil {
+			return "", 0, fmt.Errorf("hms: %v", err)
+		}
+		return token, lifetime, nil
+	})
+}
@@ -0,0 +1,75 @@
+package hms
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	var tokenRequests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&tokenRequests, 1)
+		if r.PostFormValue("grant_type") != "client_credentials" || r.PostFormValue("client_id") != "app" || r.PostFormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The first access token is expired.
+		if n == 1 {
+			w.Write([]byte(`{"access_token":"expired","expires_in":3600}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"access","expires_in":3600}`))
+	})
+	mux.HandleFunc("/v1/app/messages:send", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":"80200003","msg":"OAuth token expired."}`))
+			return
+		}
+		var body struct {
+			Message struct {
+				Data  string   `json:"data"`
+				Token []string `json:"token"`
+			} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Message.Data != `{"title":"hello"}` {
+			w.Write([]byte(`{"code":"80100003","msg":"Illegal message structure"}`))
+			return
+		}
+		if len(body.Message.Token) == 1 && body.Message.Token[0] == "dead" {
+			w.Write([]byte(`{"code":"80300007","msg":"All the tokens are invalid"}`))
+			return
+		}
+		w.Write([]byte(`{"code":"80100000","msg":"{\"success\":2,\"failure\":1,\"illegal_tokens\":[\"dead\"]}"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sender := NewSender("app", "secret")
+	sender.Endpoint = server.URL
+	sender.TokenURL = server.URL + "/token"
+
+	results := sender.Send(map[string]string{"title": "hello"}, []string{"a", "dead", "b"})
+	if len(results) != 3 {
+		t.Fatalf("len(results) = %v, want %v", len(results), 3)
+	}
+	if results[0].Err != nil || results[2].Err != nil {
+		t.Errorf("results = %+v, want a and b sent", results)
+	}
+	if !results[1].Unregistered() || results[1].Token != "dead" {
+		t.Errorf("results[1] = %+v, want an illegal token", results[1])
+	}
+
+	results = sender.Send(map[string]string{"title": "hello"}, []string{"dead"})
+	if !results[0].Unregistered() {
+		t.Errorf("results[0] = %+v, want an illegal token", results[0])
+	}
+	if n := atomic.LoadInt32(&tokenRequests); n != 2 {
+		t.Errorf("token requests = %v, want %v", n, 2)
+	}
+}
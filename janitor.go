@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"mobile-push-broadcaster/dao"
+)
+
+// maxJanitorTokens bounds the tokens listed per platform in a janitor
+// report.
+const maxJanitorTokens = 100
+
+// janitorLock prevents two janitor runs from overlapping.
+var janitorLock sync.Mutex
+
+// janitorReport describes the stale tokens of an app found by a janitor
+// run, removed unless DryRun is set.
+type janitorReport struct {
+	App    string    `json:"app"`
+	DryRun bool      `json:"dry_run"`
+	Cutoff time.Time `json:"cutoff"`
+	// Checked counts the tokens of the app, Unknown those registered
+	// before their registration time was recorded. These are given the
+	// time of the run as registration time and age from it.
+	Checked int            `json:"checked"`
+	Unknown int            `json:"unknown"`
+	Stale   map[string]int `json:"stale"`
+	// Tokens lists the first stale tokens of each platform.
+	Tokens map[string][]string `json:"tokens,omitempty"`
+}
+
+// janitorInterval is the delay between two janitor runs, a day by default.
+func janitorInterval() time.Duration {
+	if interval, err := time.ParseDuration(settings.JanitorInterval); err == nil && interval > 0 {
+		return interval
+	}
+	return 24 * time.Hour
+}
+
+// scheduleJanitor runs the janitor after the janitor interval, and again
+// after each run.
+func scheduleJanitor() {
+	jobScheduler.schedule("janitor", time.Now().Add(janitorInterval()), func() {
+		runJanitor(false)
+		scheduleJanitor()
+	})
+}
+
+// runJanitor checks the tokens of every app with a token retention, and
+// removes the tokens not registered again for token_retention_days.
+func runJanitor(dryRun bool) []janitorReport {
+	janitorLock.Lock()
+	defer janitorLock.Unlock()
+
+	reports := []janitorReport{}
+	now := time.Now()
+	for _, app := range settings.Apps {
+		if app.TokenRetention <= 0 {
+			continue
+		}
+		report := cleanStaleTokens(app.Name, now, now.AddDate(0, 0, -app.TokenRetention), dryRun)
+		stale := 0
+		for _, count := range report.Stale {
+			stale += count
+		}
+		verb := "removed"
+		if dryRun {
+			verb = "would remove"
+		}
+		log.Println("Janitor " + verb + " " + strconv.Itoa(stale) + " of the " + strconv.Itoa(report.Checked) + " tokens of " + app.Name + " not registered since " + report.Cutoff.Format(time.RFC3339))
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func cleanStaleTokens(app string, now time.Time, cutoff time.Time, dryRun bool) janitorReport {
+	report := janitorReport{App: app, DryRun: dryRun, Cutoff: cutoff, Stale: make(map[string]int), Tokens: make(map[string][]string)}
+	var devices, unknown []dao.Device
+	for _, platform := range dao.Platforms {
+		var stale []string
+		store.ForEachToken(platform, app, func(r dao.Registration) error {
+			report.Checked++
+			switch {
+			case r.Info.LastRegistered.IsZero():
+				unknown = append(unknown, dao.Device{Platform: platform, Token: r.Token})
+			case r.Info.LastRegistered.Before(cutoff):
+				stale = append(stale, r.Token)
+			}
+			return nil
+		})
+		if len(stale) == 0 {
+			continue
+		}
+
+		report.Stale[platform] = len(stale)
+		if len(stale) > maxJanitorTokens {
+			report.Tokens[platform] = stale[:maxJanitorTokens]
+		} else {
+			report.Tokens[platform] = stale
+		}
+		for _, token := range stale {
+			devices = append(devices, dao.Device{Platform: platform, Token: token})
+		}
+	}
+	report.Unknown = len(unknown)
+	if dryRun {
+		return report
+	}
+
+	if len(unknown) > 0 {
+		if err := store.StampRegistrations(app, unknown, now); err != nil {
+			log.Println("Janitor: " + err.Error())
+		}
+	}
+	// The stale tokens of the app are removed in a single write, unless
+	// registered again since they were listed.
+	if len(devices) > 0 {
+		removed, err := store.RemoveTokensIf(app, devices, func(info dao.TokenInfo) bool {
+			return !info.LastRegistered.IsZero() && info.LastRegistered.Before(cutoff)
+		})
+		if err != nil {
+			log.Println("Janitor: " + err.Error())
+		}
+		for i, ok := range removed {
+			if !ok {
+				report.Stale[devices[i].Platform]--
+			}
+		}
+	}
+	return report
+}
+
+// janitor runs the janitor now, the dry_run param only reports the stale
+// tokens.
+func janitor(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{"status": "success", "reports": runJanitor(dryRun)})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"mobile-push-broadcaster/push"
+)
+
+const jobsBucket = "jobs"
+
+// Job statuses.
+const (
+	jobScheduled = "scheduled"
+	jobPending   = "pending"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCanceled  = "canceled"
+)
+
+// job is a broadcast and its outcome, persisted in the DB so that callers
+// can follow it after /broadcast returned.
+type job struct {
+	ID        string                  `json:"id"`
+	Status    string                  `json:"status"`
+	App       string                  `json:"app"`
+	Payload   map[string]string       `json:"payload"`
+	Platforms []string                `json:"platforms"`
+	Created   time.Time               `json:"created"`
+	SendAt    time.Time               `json:"send_at"`
+	Delivery  string                  `json:"delivery,omitempty"`
+	LocalTime string                  `json:"local_time,omitempty"`
+	Cohorts   []*cohort               `json:"cohorts,omitempty"`
+	Started   time.Time               `json:"started"`
+	Ended     time.Time               `json:"ended"`
+	Results   map[string]*push.Report `json:"results"`
+	Errors    map[string]string       `json:"errors,omitempty"`
+
+	lock sync.Mutex
+}
+
+// newJobID returns a random ID prefixed by the creation time, so that jobs
+// are listed in creation order.
+func newJobID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%016x", time.Now().UnixNano()) + hex.EncodeToString(suffix)
+}
+
+func newJob(app string, payload map[string]string, platforms []string) *job {
+	return &job{
+		ID:        newJobID(),
+		Status:    jobPending,
+		App:       app,
+		Payload:   payload,
+		Platforms: platforms,
+		Created:   time.Now(),
+		Results:   make(map[string]*push.Report),
+		Errors:    make(map[string]string),
+	}
+}
+
+// save writes the job to the DB. The caller holds the job lock.
+func (j *job) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	return store.PutRecord(jobsBucket, j.ID, data)
+}
+
+// run broadcasts the job on each of its platforms concurrently and saves
+// its progress as the platforms complete.
+func (j *job) run() {
+	j.lock.Lock()
+	j.Status = jobRunning
+	j.Started = time.Now()
+	if err := j.save(); err != nil {
+		log.Println("Job " + j.ID + " not saved: " + err.Error())
+	}
+	j.lock.Unlock()
+
+	msg := push.Message{App: j.App, Data: j.Payload}
+	var wg sync.WaitGroup
+	for _, platform := range j.Platforms {
+		wg.Add(1)
+		go func(platform string) {
+			defer wg.Done()
+			report := push.Report{Platform: platform}
+			filter, err := segmentFilter(platform, j.App, j.Payload["segment"])
+			if err == nil {
+				report, err = broadcaster.BroadcastSelect(platform, msg, filter)
+			}
+
+			j.lock.Lock()
+			defer j.lock.Unlock()
+			j.Results[platform] = &report
+			if err != nil {
+				j.Errors[platform] = err.Error()
+			}
+			if err := j.save(); err != nil {
+				log.Println("Job " + j.ID + " not saved: " + err.Error())
+			}
+		}(platform)
+	}
+	wg.Wait()
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.Status = jobDone
+	if len(j.Errors) > 0 {
+		j.Status = jobFailed
+	}
+	j.Ended = time.Now()
+	if err := j.save(); err != nil {
+		log.Println("Job " + j.ID + " not saved: " + err.Error())
+	}
+}
+
+func loadJob(id string) (*job, error) {
+	data, err := store.GetRecord(jobsBucket, id)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var j job
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+	if j.Results == nil {
+		j.Results = make(map[string]*push.Report)
+	}
+	if j.Errors == nil {
+		j.Errors = make(map[string]string)
+	}
+	return &j, nil
+}
+
+// loadJobs returns the jobs of an app, or of every app when app is empty,
+// newest first.
+func loadJobs(app string) ([]*job, error) {
+	var jobs []*job
+	err := store.ForEachRecord(jobsBucket, func(key string, value []byte) error {
+		var j job
+		if err := json.Unmarshal(value, &j); err != nil {
+			return err
+		}
+		if j.Results == nil {
+			j.Results = make(map[string]*push.Report)
+		}
+		if j.Errors == nil {
+			j.Errors = make(map[string]string)
+		}
+		if app == "" || j.App == app {
+			jobs = append(jobs, &j)
+		}
+		return nil
+	})
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].ID > jobs[b].ID })
+	return jobs, err
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) {
+	j, err := loadJob(mux.Vars(r)["id"])
+	if err != nil {
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	if j == nil {
+		renderer.JSON(w, http.StatusNotFound, map[string]string{"status": "error", "message": "No job with this id"})
+		return
+	}
+	renderer.JSON(w, http.StatusOK, j)
+}
+
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	jobs, err := loadJobs(r.URL.Query().Get("app"))
+	if err != nil {
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit >= 0 && limit < len(jobs) {
+		jobs = jobs[:limit]
+	}
+	if jobs == nil {
+		jobs = []*job{}
+	}
+	renderer.JSON(w, http.StatusOK, jobs)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mobile-push-broadcaster/push"
+)
+
+// Delivery modes of a broadcast.
+const (
+	deliveryNow   = ""
+	deliveryLocal = "local"
+)
+
+// cohortsBucket keeps the progress of the cohorts being sent.
+const cohortsBucket = "cohorts"
+
+// cohortsLock serializes the updates of the jobs delivered in local time,
+// whose cohorts are released concurrently.
+var cohortsLock sync.Mutex
+
+// cohort is the audience of a local-time job living in one timezone.
+type cohort struct {
+	Timezone  string                  `json:"timezone"`
+	ReleaseAt time.Time               `json:"release_at"`
+	Status    string                  `json:"status"`
+	Results   map[string]*push.Report `json:"results"`
+	Errors    map[string]string       `json:"errors,omitempty"`
+}
+
+func defaultTimezone() string {
+	if settings.DefaultTimezone != "" {
+		return settings.DefaultTimezone
+	}
+	return "UTC"
+}
+
+// parseLocalTime reads a local_time param given as HH:MM.
+func parseLocalTime(value string) (int, int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, 0, errors.New("local_time must be given as HH:MM")
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// nextLocalTime returns the next time the clock of loc shows hour:minute.
+func nextLocalTime(now time.Time, hour int, minute int, loc *time.Location) time.Time {
+	local := now.In(loc)
+	release := time.Date(local.Year(), local.Month(), local.Day(), hour, minute, 0, 0, loc)
+	if release.Before(local) {
+		release = time.Date(local.Year(), local.Month(), local.Day()+1, hour, minute, 0, 0, loc)
+	}
+	return release
+}
+
+// cohortFilter returns the filter of the pages of tokens of platform living
+// in timezone and matching the segment expression. Tokens without timezone
+// belong to the default timezone.
+func cohortFilter(platform string, app string, timezone string, expr string) (func(tokens []string) []string, error) {
+	inSegment, err := segmentFilter(platform, app, expr)
+	if err != nil {
+		return nil, err
+	}
+	return func(tokens []string) []string {
+		selected := []string{}
+		for _, token := range tokens {
+			tokenTimezone := store.GetTokenTimezone(platform, app, token)
+			if tokenTimezone == timezone || tokenTimezone == "" && timezone == defaultTimezone() {
+				selected = append(selected, token)
+			}
+		}
+		if inSegment != nil {
+			selected = inSegment(selected)
+		}
+		return selected
+	}, nil
+}
+
+// startLocalDelivery splits the audience of a job into timezone cohorts and
+// schedules each of them at the job's local time. The tokens are scanned
+// before taking the cohorts lock, the job is not visible until saved.
+func startLocalDelivery(j *job) error {
+	hour, minute, err := parseLocalTime(j.LocalTime)
+	if err != nil {
+		return err
+	}
+
+	timezones := map[string]bool{}
+	for _, platform := range j.Platforms {
+		for _, timezone := range store.GetTimezones(platform, j.App) {
+			if timezone == "" {
+				timezone = defaultTimezone()
+			}
+			timezones[timezone] = true
+		}
+	}
+
+	now := time.Now()
+	j.Cohorts = nil
+	for timezone := range timezones {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			log.Println("Job " + j.ID + ": unknown timezone " + timezone)
+			continue
+		}
+		j.Cohorts = append(j.Cohorts, &cohort{
+			Timezone:  timezone,
+			ReleaseAt: nextLocalTime(now, hour, minute, loc),
+			Status:    jobScheduled,
+			Results:   make(map[string]*push.Report),
+			Errors:    make(map[string]string),
+		})
+	}
+	sort.Slice(j.Cohorts, func(a, b int) bool { return j.Cohorts[a].ReleaseAt.Before(j.Cohorts[b].ReleaseAt) })
+
+	j.Status = jobRunning
+	j.Started = now
+	if len(j.Cohorts) == 0 {
+		j.Status = jobDone
+		j.Ended = now
+	}
+
+	cohortsLock.Lock()
+	defer cohortsLock.Unlock()
+	if err := j.save(); err != nil {
+		return err
+	}
+	scheduleCohorts(j)
+	return nil
+}
+
+func scheduleCohorts(j *job) {
+	id := j.ID
+	for _, c := range j.Cohorts {
+		if c.Status != jobScheduled {
+			continue
+		}
+		timezone := c.Timezone
+		jobScheduler.schedule("cohort#"+id+"#"+timezone, c.ReleaseAt, func() {
+			releaseCohort(id, timezone)
+		})
+	}
+}
+
+func (j *job) cohort(timezone string) *cohort {
+	for _, c := range j.Cohorts {
+		if c.Timezone == timezone {
+			return c
+		}
+	}
+	return nil
+}
+
+// releaseCohort sends a local-time job to the devices of one timezone and
+// closes the job once its last cohort is sent.
+func releaseCohort(id string, timezone string) {
+	cohortsLock.Lock()
+	j, err := loadJob(id)
+	if err != nil || j == nil || j.Status != jobRunning || j.cohort(timezone) == nil || j.cohort(timezone).Status != jobScheduled {
+		cohortsLock.Unlock()
+		return
+	}
+	j.cohort(timezone).Status = jobRunning
+	if err := j.save(); err != nil {
+		log.Println("Job " + id + " not saved: " + err.Error())
+	}
+	cohortsLock.Unlock()
+
+	log.Println("Release job " + id + " for the timezone " + timezone)
+	results := make(map[string]*push.Report)
+	errs := make(map[string]string)
+	for _, platform := range j.Platforms {
+		report, err := sendCohort(j, timezone, platform)
+		results[platform] = &report
+		if err == errJobCanceled {
+			break
+		}
+		if err != nil {
+			errs[platform] = err.Error()
+		}
+	}
+
+	cohortsLock.Lock()
+	defer cohortsLock.Unlock()
+	if j, err = loadJob(id); err != nil || j == nil {
+		return
+	}
+	c := j.cohort(timezone)
+	c.Status = jobDone
+	if j.Status == jobCanceled {
+		c.Status = jobCanceled
+	}
+	c.Results = results
+	c.Errors = errs
+	for platform, report := range results {
+		total := j.Results[platform]
+		if total == nil {
+			total = &push.Report{Platform: platform}
+			j.Results[platform] = total
+		}
+		addReport(total, *report)
+	}
+	for platform, err := range errs {
+		j.Errors[platform] = err
+	}
+
+	remaining := 0
+	for _, c := range j.Cohorts {
+		if c.Status == jobScheduled || c.Status == jobRunning {
+			remaining++
+		}
+	}
+	if remaining == 0 && j.Status == jobRunning {
+		j.Status = jobDone
+		if len(j.Errors) > 0 {
+			j.Status = jobFailed
+		}
+		j.Ended = time.Now()
+	}
+	if err := j.save(); err != nil {
+		log.Println("Job " + id + " not saved: " + err.Error())
+		return
+	}
+	deleteCohortProgress(id, timezone)
+}
+
+// errJobCanceled stops the cohort of a job canceled while it was sent.
+var errJobCanceled = errors.New("The job was canceled")
+
+// cohortPage is the progress of a cohort, saved in the cohorts bucket
+// once a page of its devices was sent.
+type cohortPage struct {
+	Tokens []string    `json:"tokens"`
+	Report push.Report `json:"report"`
+}
+
+// sendCohort sends a local-time job to the devices of platform living in
+// timezone, a page at a time. The devices of each page are saved once it
+// is sent, a cohort interrupted by a restart skips them when it resumes.
+func sendCohort(j *job, timezone string, platform string) (push.Report, error) {
+	report := push.Report{Platform: platform}
+	prefix := j.ID + "#" + timezone + "#" + platform + "#"
+	sent := make(map[string]bool)
+	pages := 0
+	err := store.ForEachRecord(cohortsBucket, func(key string, value []byte) error {
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		var page cohortPage
+		if err := json.Unmarshal(value, &page); err != nil {
+			return err
+		}
+		for _, token := range page.Tokens {
+			sent[token] = true
+		}
+		addReport(&report, page.Report)
+		pages++
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if pages > 0 {
+		log.Println("Job " + j.ID + " resumes the " + platform + " devices of " + timezone + " after " + strconv.Itoa(len(sent)) + " devices")
+	}
+	inCohort, err := cohortFilter(platform, j.App, timezone, j.Payload["segment"])
+	if err != nil {
+		return report, err
+	}
+
+	msg := push.Message{App: j.App, Data: j.Payload}
+	err = store.ForEachTokenPage(platform, j.App, push.DefaultPageSize, func(tokens []string) error {
+		if current, err := loadJob(j.ID); err == nil && current != nil && current.Status == jobCanceled {
+			return errJobCanceled
+		}
+		tokens = inCohort(tokens)
+		if len(sent) > 0 {
+			unsent := tokens[:0]
+			for _, token := range tokens {
+				if !sent[token] {
+					unsent = append(unsent, token)
+				}
+			}
+			tokens = unsent
+		}
+		if len(tokens) == 0 {
+			return nil
+		}
+
+		page := cohortPage{Tokens: tokens}
+		var results []push.Result
+		var err error
+		page.Report, results, err = broadcaster.SendResults(platform, msg, tokens)
+		if err != nil {
+			return err
+		}
+		// The devices keep their canonical ID once the page is sent.
+		for _, result := range results {
+			if result.CanonicalID != "" {
+				page.Tokens = append(page.Tokens, result.CanonicalID)
+			}
+		}
+		addReport(&report, page.Report)
+		data, err := json.Marshal(page)
+		if err == nil {
+			err = store.PutRecord(cohortsBucket, prefix+strconv.Itoa(pages), data)
+		}
+		if err != nil {
+			log.Println("Job " + j.ID + ": progress of " + timezone + " not saved: " + err.Error())
+		}
+		pages++
+		return nil
+	})
+	return report, err
+}
+
+// deleteCohortProgress deletes the saved progress of a cohort, once it is
+// sent.
+func deleteCohortProgress(id string, timezone string) {
+	var keys []string
+	err := store.ForEachRecord(cohortsBucket, func(key string, value []byte) error {
+		if strings.HasPrefix(key, id+"#"+timezone+"#") {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	for _, key := range keys {
+		if err == nil {
+			err = store.DeleteRecord(cohortsBucket, key)
+		}
+	}
+	if err != nil {
+		log.Println("Job " + id + ": progress of " + timezone + " not deleted: " + err.Error())
+	}
+}
+
+// addReport adds the counts of a report to total.
+func addReport(total *push.Report, report push.Report) {
+	total.Tokens += report.Tokens
+	total.Sent += report.Sent
+	total.Failed += report.Failed
+	total.Removed += report.Removed
+	total.Canonical += report.Canonical
+	total.Duration += report.Duration
+}
+
+// cancelLocalDelivery cancels the cohorts of a local-time job not sent
+// yet, a cohort being sent stops after its current page. It returns the
+// HTTP status to report when the job cannot be canceled.
+func cancelLocalDelivery(id string) (int, error) {
+	cohortsLock.Lock()
+	defer cohortsLock.Unlock()
+	j, err := loadJob(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if j == nil {
+		return http.StatusNotFound, errors.New("No job with this id")
+	}
+	if j.Status != jobRunning {
+		return http.StatusConflict, errors.New("The job is " + j.Status + ", it can no longer be canceled")
+	}
+
+	for _, c := range j.Cohorts {
+		if c.Status == jobScheduled {
+			jobScheduler.cancel("cohort#" + id + "#" + c.Timezone)
+			c.Status = jobCanceled
+		}
+	}
+	j.Status = jobCanceled
+	j.Ended = time.Now()
+	if err := j.save(); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// reloadLocalDeliveries schedules again the cohorts that were not released
+// before a restart.
+func reloadLocalDeliveries() error {
+	jobs, err := loadJobs("")
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if j.Delivery != deliveryLocal || j.Status != jobRunning {
+			continue
+		}
+		for _, c := range j.Cohorts {
+			// A cohort interrupted while sending resumes, skipping the
+			// devices of the pages it saved.
+			if c.Status == jobRunning {
+				c.Status = jobScheduled
+			}
+		}
+		if err := j.save(); err != nil {
+			return err
+		}
+		scheduleCohorts(j)
+	}
+	return nil
+}
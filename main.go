@@ -7,19 +7,19 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 
 	"mobile-push-broadcaster/dao"
+	"mobile-push-broadcaster/push"
+	"mobile-push-broadcaster/segment"
+	"mobile-push-broadcaster/tokencheck"
 	"mobile-push-broadcaster/web_logs"
-
-	"github.com/alexjlockwood/gcm"
-	"github.com/timehop/apns"
+	"mobile-push-broadcaster/webpush"
 )
 
 type webPageInfo struct {
@@ -34,6 +34,9 @@ type appInfo struct {
 	AndroidDevices    int
 	IOSDevices        int
 	IOSSandboxDevices int
+	WebPushDevices    int
+	HuaweiDevices     int
+	FireDevices       int
 	Fields            []field
 }
 
@@ -45,42 +48,122 @@ type field struct {
 
 type appSettings struct {
 	Name            string  `json:"name"`
-	GcmAPIKey       string  `json:"gcm_api_key"`
+	FcmCredentials  string  `json:"fcm_service_account"`
+	ApnsTopic       string  `json:"apns_topic"`
+	ApnsTeamID      string  `json:"apns_team_id"`
+	ApnsKeyID       string  `json:"apns_key_id"`
+	ApnsAuthKey     string  `json:"apns_auth_key"`
+	ApnsExpiration  int     `json:"apns_expiration"`
 	ApnsCert        string  `json:"apns_cert"`
 	ApnsKey         string  `json:"apns_key"`
 	ApnsCertSandbox string  `json:"apns_cert_sandbox"`
 	ApnsKeySandbox  string  `json:"apns_key_sandbox"`
+	HmsAppID        string  `json:"hms_app_id"`
+	HmsAppSecret    string  `json:"hms_app_secret"`
+	AdmClientID     string  `json:"adm_client_id"`
+	AdmClientSecret string  `json:"adm_client_secret"`
+	TokenRetention  int     `json:"token_retention_days"`
 	Fields          []field `json:"fields"`
+
+	// TokenValidation is the validation mode of the tokens of each
+	// platform, see tokencheck.
+	TokenValidation map[string]string `json:"token_validation"`
+
+	// The VAPID key pair of the Web Push, base64url encoded as the
+	// web-push libraries generate it, and the mailto: or https: contact
+	// of the broadcaster.
+	VapidPublicKey  string `json:"vapid_public_key"`
+	VapidPrivateKey string `json:"vapid_private_key"`
+	VapidSubject    string `json:"vapid_subject"`
 }
 
 var settings struct {
-	Login    string        `json:"login"`
-	Password string        `json:"password"`
-	Server   string        `json:"server"`
-	PORT     string        `json:"port"`
-	Apps     []appSettings `json:"apps"`
+	Login            string        `json:"login"`
+	Password         string        `json:"password"`
+	Server           string        `json:"server"`
+	PORT             string        `json:"port"`
+	FcmEndpoint      string        `json:"fcm_endpoint"`
+	FcmTokenEndpoint string        `json:"fcm_token_endpoint"`
+	ApnsHost         string        `json:"apns_host"`
+	ApnsSandboxHost  string        `json:"apns_sandbox_host"`
+	HmsEndpoint      string        `json:"hms_endpoint"`
+	HmsTokenEndpoint string        `json:"hms_token_endpoint"`
+	AdmEndpoint      string        `json:"adm_endpoint"`
+	AdmTokenEndpoint string        `json:"adm_token_endpoint"`
+	DefaultTimezone  string        `json:"default_timezone"`
+	Database         string        `json:"database"`
+	DatabaseBackend  string        `json:"database_backend"`
+	JanitorInterval  string        `json:"janitor_interval"`
+	DatabaseKeyFile  string        `json:"encryption_key_file"`
+	LazyTokens       bool          `json:"lazy_tokens"`
+	Apps             []appSettings `json:"apps"`
 }
 
-const maxGcmTokens = 1000
-
 var renderer = render.New()
 
+var providers = push.NewRegistry()
+
+var jobScheduler = newScheduler()
+
+// store holds the tokens and the records, it is opened by main.
+var store dao.Store
+
+var broadcaster *push.Broadcaster
+
 func main() {
 	staticFilesDir := "."
 	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(os.Args[1] + ": " + err.Error())
+			}
+			return
+		}
 		staticFilesDir = os.Args[1]
 	}
 
-	loadConfig(staticFilesDir)
+	if err := loadConfig(staticFilesDir); err != nil {
+		log.Fatal("Config not loaded: " + err.Error())
+	}
 
 	// Load tokens from Storage
 	log.Println("Load the Tokens from Storage")
-	dao.InitCache()
+	var err error
+	store, err = openStore()
+	if err != nil {
+		log.Fatal("Storage not opened: " + err.Error())
+	}
+	defer store.Close()
 	log.Println("Tokens loaded")
 
+	broadcaster = &push.Broadcaster{
+		Providers: providers,
+		Tokens:    store,
+		Logs:      broadcastLogs,
+	}
+
+	providers.Register(dao.GCM, fcmProvider{})
+	providers.Register(dao.APNS, apnsProvider{})
+	providers.Register(dao.APNSSandbox, apnsProvider{sandbox: true})
+	providers.Register(dao.WebPush, webPushProvider{})
+	providers.Register(dao.HMS, hmsProvider{})
+	providers.Register(dao.ADM, admProvider{})
+
+	if err := reloadScheduledJobs(); err != nil {
+		log.Println("Scheduled broadcasts not reloaded: " + err.Error())
+	}
+	if err := reloadLocalDeliveries(); err != nil {
+		log.Println("Local time deliveries not reloaded: " + err.Error())
+	}
+	if err := reloadRecurrings(); err != nil {
+		log.Println("Recurring broadcasts not reloaded: " + err.Error())
+	}
+	scheduleJanitor()
+	go jobScheduler.loop()
+
 	renderer = render.New(render.Options{
 		Directory: staticFilesDir + "/web",
-		Delims:    render.Delims{"{[{", "}]}"},
+		Delims:    render.Delims{Left: "{[{", Right: "}]}"},
 	})
 
 	r := mux.NewRouter()
@@ -88,13 +171,42 @@ func main() {
 	r.HandleFunc("/", basicAuth(index)).Methods("GET")
 	r.HandleFunc("/new", basicAuth(index2)).Methods("GET")
 	r.HandleFunc("/broadcast", basicAuth(broadcast)).Methods("GET")
-
-	r.HandleFunc("/gcm/register", registerGcm).Methods("POST")
-	r.HandleFunc("/gcm/unregister", unregisterGcm).Methods("POST")
-	r.HandleFunc("/apns/register", registerApns).Methods("POST")
-	r.HandleFunc("/apns/unregister", unregisterApns).Methods("POST")
-	r.HandleFunc("/apns/register_sandbox", registerApnsSandbox).Methods("POST")
-	r.HandleFunc("/apns/unregister_sandbox", unregisterApnsSandbox).Methods("POST")
+	r.HandleFunc("/send", basicAuth(send)).Methods("POST")
+	r.HandleFunc("/send/user", basicAuth(sendToUser)).Methods("POST")
+	r.HandleFunc("/users/{app}/{user}/devices", basicAuth(listUserDevices)).Methods("GET")
+	r.HandleFunc("/audience", basicAuth(getAudience)).Methods("GET")
+	r.HandleFunc("/tokens/{app}/export", basicAuth(exportAppTokens)).Methods("GET")
+	r.HandleFunc("/tokens/{app}/import", basicAuth(importAppTokens)).Methods("POST")
+	r.HandleFunc("/tokens/{app}/register", basicAuth(bulkRegister)).Methods("POST")
+	r.HandleFunc("/tokens/{app}/unregister", basicAuth(bulkUnregister)).Methods("POST")
+	r.HandleFunc("/janitor", basicAuth(janitor)).Methods("POST")
+	r.HandleFunc("/backup", basicAuth(backup)).Methods("GET")
+	r.HandleFunc("/jobs", basicAuth(listJobs)).Methods("GET")
+	r.HandleFunc("/jobs/{id}", basicAuth(getJob)).Methods("GET")
+	r.HandleFunc("/scheduled", basicAuth(listScheduled)).Methods("GET")
+	r.HandleFunc("/scheduled/{id}", basicAuth(editScheduled)).Methods("PUT")
+	r.HandleFunc("/scheduled/{id}", basicAuth(cancelScheduled)).Methods("DELETE")
+	r.HandleFunc("/recurring", basicAuth(listRecurring)).Methods("GET")
+	r.HandleFunc("/recurring", basicAuth(createRecurring)).Methods("POST")
+	r.HandleFunc("/recurring/{id}", basicAuth(withRecurring(getRecurring))).Methods("GET")
+	r.HandleFunc("/recurring/{id}", basicAuth(withRecurring(editRecurring))).Methods("PUT")
+	r.HandleFunc("/recurring/{id}", basicAuth(withRecurring(deleteRecurring))).Methods("DELETE")
+	r.HandleFunc("/recurring/{id}/pause", basicAuth(withRecurring(pauseRecurring))).Methods("POST")
+	r.HandleFunc("/recurring/{id}/resume", basicAuth(withRecurring(resumeRecurring))).Methods("POST")
+	r.HandleFunc("/recurring/{id}/next", basicAuth(withRecurring(previewRecurring))).Methods("GET")
+
+	r.HandleFunc("/gcm/register", registerHandler(dao.GCM)).Methods("POST")
+	r.HandleFunc("/gcm/unregister", unregisterHandler(dao.GCM)).Methods("POST")
+	r.HandleFunc("/apns/register", registerHandler(dao.APNS)).Methods("POST")
+	r.HandleFunc("/apns/unregister", unregisterHandler(dao.APNS)).Methods("POST")
+	r.HandleFunc("/apns/register_sandbox", registerHandler(dao.APNSSandbox)).Methods("POST")
+	r.HandleFunc("/apns/unregister_sandbox", unregisterHandler(dao.APNSSandbox)).Methods("POST")
+	r.HandleFunc("/hms/register", registerHandler(dao.HMS)).Methods("POST")
+	r.HandleFunc("/hms/unregister", unregisterHandler(dao.HMS)).Methods("POST")
+	r.HandleFunc("/adm/register", registerHandler(dao.ADM)).Methods("POST")
+	r.HandleFunc("/adm/unregister", unregisterHandler(dao.ADM)).Methods("POST")
+	r.HandleFunc("/webpush/register", registerHandler(dao.WebPush)).Methods("POST")
+	r.HandleFunc("/webpush/unregister", unregisterHandler(dao.WebPush)).Methods("POST")
 	r.HandleFunc("/sock_gcm", web_logs.SockGCM).Methods("GET")
 	r.HandleFunc("/sock_apns", web_logs.SockAPNS).Methods("GET")
 
@@ -115,16 +227,43 @@ func basicAuth(pass http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func loadConfig(staticFilesDir string) {
+func loadConfig(staticFilesDir string) error {
 	configFile, err := os.Open(staticFilesDir + "/config.json")
 	if err != nil {
-		fmt.Errorf("opening config file", err.Error())
+		return fmt.Errorf("opening config file: %v", err)
 	}
+	defer configFile.Close()
 
 	jsonParser := json.NewDecoder(configFile)
 	if err = jsonParser.Decode(&settings); err != nil {
-		fmt.Errorf("parsing config file", err.Error())
+		return fmt.Errorf("parsing config file: %v", err)
 	}
+	for _, app := range settings.Apps {
+		for platform, mode := range app.TokenValidation {
+			if !dao.ValidPlatform(platform) || !tokencheck.ValidMode(mode) {
+				return fmt.Errorf("invalid token_validation of %s: %s %q", app.Name, platform, mode)
+			}
+		}
+	}
+	return nil
+}
+
+// databasePath is the file of the bolt DB, broadcaster.db by default.
+func databasePath() string {
+	if settings.Database == "" {
+		return "broadcaster.db"
+	}
+	return settings.Database
+}
+
+// openStore opens the storage configured by the database settings. The
+// bolt DB is migrated to the current schema version if needed.
+func openStore() (dao.Store, error) {
+	options, err := storeOptions()
+	if err != nil {
+		return nil, err
+	}
+	return dao.Open(databasePath(), options)
 }
 
 func getAppConfig(app string) (appSettings, error) {
@@ -139,7 +278,7 @@ func getPageInfo() webPageInfo {
 	var webPageInfo webPageInfo
 	var appInfos []appInfo
 	for _, element := range settings.Apps {
-		appInfo := appInfo{element.Name, strings.Replace(element.Name, "|", "", -1), dao.GetNbGCMTokens(element.Name), dao.GetNbAPNSTokens(element.Name), dao.GetNbAPNSSandboxTokens(element.Name), element.Fields}
+		appInfo := appInfo{element.Name, strings.Replace(element.Name, "|", "", -1), store.GetNbTokens(dao.GCM, element.Name), store.GetNbTokens(dao.APNS, element.Name), store.GetNbTokens(dao.APNSSandbox, element.Name), store.GetNbTokens(dao.WebPush, element.Name), store.GetNbTokens(dao.HMS, element.Name), store.GetNbTokens(dao.ADM, element.Name), element.Fields}
 		appInfos = append(appInfos, appInfo)
 	}
 	webPageInfo.Server = settings.Server
@@ -156,299 +295,232 @@ func index2(w http.ResponseWriter, r *http.Request) {
 	renderer.HTML(w, http.StatusOK, "broadcaster2", getPageInfo())
 }
 
-func broadcast(w http.ResponseWriter, r *http.Request) {
-	var params = make(map[string]interface{})
-	for k, v := range r.URL.Query() {
+// broadcastFlags maps the query flags of /broadcast to their platform.
+var broadcastFlags = map[string]string{
+	"GCM":         dao.GCM,
+	"APNS":        dao.APNS,
+	"APNSSandbox": dao.APNSSandbox,
+	"WebPush":     dao.WebPush,
+	"HMS":         dao.HMS,
+	"ADM":         dao.ADM,
+}
+
+// broadcastParams reads the payload of a broadcast from the query, or the
+// form, and the platforms selected by its flags.
+func broadcastParams(r *http.Request) (map[string]string, []string) {
+	r.ParseForm()
+	var params = make(map[string]string)
+	for k, v := range r.Form {
 		params[k] = v[0]
 	}
 
-	if params["app"] == nil {
-		log.Println("app is not defined")
-		return
+	var platforms []string
+	for flag, platform := range broadcastFlags {
+		if params[flag] == "true" {
+			platforms = append(platforms, platform)
+		}
 	}
+	sort.Strings(platforms)
+	return params, platforms
+}
 
-	if params["GCM"] == "true" {
-		go sendGcm(params)
-	}
-	if params["APNS"] == "true" {
-		go sendApns(params)
+// checkBroadcastParams validates the segment and the delivery of a
+// broadcast, before it is started, scheduled or edited.
+func checkBroadcastParams(params map[string]string) error {
+	if params["segment"] != "" {
+		if _, err := segment.Parse(params["segment"]); err != nil {
+			return err
+		}
 	}
-	if params["APNSSandbox"] == "true" {
-		go sendApnsSandbox(params)
+	switch params["delivery"] {
+	case deliveryNow:
+		return nil
+	case deliveryLocal:
+		if params["send_at"] != "" {
+			return errors.New("send_at cannot be used with the local delivery")
+		}
+		_, _, err := parseLocalTime(params["local_time"])
+		return err
 	}
+	return errors.New("delivery must be empty or local")
 }
 
-func registerGcm(w http.ResponseWriter, r *http.Request) {
-	app := r.PostFormValue("app")
-	token := r.PostFormValue("token")
-	if token == "" || app == "" {
-		log.Println("RegisterGcm: app or token empty")
-		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "app and token params are required"})
+func broadcast(w http.ResponseWriter, r *http.Request) {
+	params, platforms := broadcastParams(r)
+	if params["app"] == "" {
+		log.Println("app is not defined")
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "app param is required"})
 		return
 	}
-	log.Println("Register GCM token: " + token)
-	dao.AddGCMToken(app, token)
 
-	renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Token saved"})
-}
-
-func unregisterGcm(w http.ResponseWriter, r *http.Request) {
-	app := r.PostFormValue("app")
-	token := r.PostFormValue("token")
-	if token == "" || app == "" {
-		log.Println("UnregisterGcm: app or token empty")
-		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "app and token params are required"})
+	if err := checkBroadcastParams(params); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
 		return
 	}
-	log.Println("Unregister GCM token: " + token)
-	dao.RemoveGCMToken(app, token)
-	renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Token deleted"})
-}
 
-func registerApns(w http.ResponseWriter, r *http.Request) {
-	app := r.PostFormValue("app")
-	token := r.PostFormValue("token")
-	if token == "" || app == "" {
-		log.Println("RegisterApns: app or token empty")
-		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "app and token params are required"})
+	j := newJob(params["app"], params, platforms)
+	if params["delivery"] == deliveryLocal {
+		j.Delivery = deliveryLocal
+		j.LocalTime = params["local_time"]
+		if err := startLocalDelivery(j); err != nil {
+			renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+			return
+		}
+		renderer.JSON(w, http.StatusOK, map[string]interface{}{"status": "success", "message": "Broadcast scheduled in local time", "job_id": j.ID, "cohorts": len(j.Cohorts)})
 		return
 	}
-	log.Println("Register APNS token: " + token)
-	dao.AddAPNSToken(app, token)
-	renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Token saved"})
-}
-
-func unregisterApns(w http.ResponseWriter, r *http.Request) {
-	app := r.PostFormValue("app")
-	token := r.PostFormValue("token")
-	if token == "" || app == "" {
-		log.Println("UnregisterApns: app or token empty")
-		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "app and token params are required"})
-		return
+	if params["send_at"] != "" {
+		sendAt, err := parseSendAt(params["send_at"])
+		if err != nil {
+			renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+			return
+		}
+		j.Status = jobScheduled
+		j.SendAt = sendAt
 	}
-	log.Println("Unregister APNS token: " + token)
-	dao.RemoveAPNSToken(app, token)
-	renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Token deleted"})
-}
-
-func registerApnsSandbox(w http.ResponseWriter, r *http.Request) {
-	app := r.PostFormValue("app")
-	token := r.PostFormValue("token")
-	log.Println("app: " + app)
-	if token == "" || app == "" {
-		log.Println("RegisterApnsSandbox: app or token empty")
-		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "app and token params are required"})
+	if err := j.save(); err != nil {
+		log.Println("Broadcast: job not saved: " + err.Error())
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
 		return
 	}
-	log.Println("Register APNSSandbox token: " + token)
-	dao.AddAPNSSandboxToken(app, token)
-	renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Token saved"})
-}
 
-func unregisterApnsSandbox(w http.ResponseWriter, r *http.Request) {
-	app := r.PostFormValue("app")
-	token := r.PostFormValue("token")
-	if token == "" || app == "" {
-		log.Println("UnregisterApnsSandbox: app or token empty")
-		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "app and token params are required"})
+	if j.Status == jobScheduled {
+		scheduleJob(j)
+		renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Broadcast scheduled", "job_id": j.ID})
 		return
 	}
-	log.Println("Unregister APNSSandbox token: " + token)
-	dao.RemoveAPNSSandboxToken(app, token)
-	renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Token deleted"})
+	go j.run()
+	renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Broadcast started", "job_id": j.ID})
 }
 
-func sendGcm(params map[string]interface{}) {
-	var wg sync.WaitGroup
-	t1 := time.Now()
-	tokens := dao.GetGCMTokens(params["app"].(string))
-
-	var reqNumber int
-	for i := 0; i < len(tokens); i = i + maxGcmTokens {
-		max := i + maxGcmTokens
-		if max >= len(tokens) {
-			max = len(tokens)
+// registerHandler returns the handler registering the devices of a platform
+// with their metadata, timezone, tags and user.
+func registerHandler(platform string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app, token, logged, ok := readToken(w, r, platform, "Register")
+		if !ok {
+			return
 		}
-		reqNumber = reqNumber + 1
-		log.Println("Send request " + strconv.Itoa(reqNumber) + " to the GCM server")
-		wg.Add(1)
-		go sendRequestToGCM(params, tokens[i:max], reqNumber, &wg)
-	}
-
-	wg.Wait()
-	t2 := time.Now()
-	duration := t2.Sub(t1)
-	web_logs.GCMLogs("Notifications sent to " + strconv.Itoa(len(tokens)) + " Android devices in " + duration.String())
-	log.Println("Notifications sent to " + strconv.Itoa(len(tokens)) + " Android devices in " + duration.String())
-}
-func sendRequestToGCM(data map[string]interface{}, toks []string, reqNumber int, wg *sync.WaitGroup) {
-	tokens := make([]string, len(toks))
-	copy(tokens, toks)
-
-	t1 := time.Now()
-	msg := gcm.NewMessage(data, tokens...)
-
-	appSettings, appError := getAppConfig(data["app"].(string))
-	if appError != nil {
-		return
-	}
-	sender := &gcm.Sender{ApiKey: appSettings.GcmAPIKey}
-
-	// Send the message and receive the response after at most two retries.
-	resp, err := sender.Send(msg, 2)
-	if err != nil {
-		log.Println("ERROR: " + err.Error())
-		web_logs.GCMLogs("ERROR: " + err.Error())
-	}
-	if resp != nil {
-		res, _ := json.Marshal(resp)
-		log.Println(string(res))
-
-		if resp.Failure > 0 || resp.CanonicalIDs > 0 {
-			var app = data["app"].(string)
-			for index, el := range resp.Results {
-				if el.Error != "" && el.RegistrationID == "" {
-					go dao.RemoveGCMToken(app, tokens[index])
-				} else if el.RegistrationID != "" {
-					go dao.RemoveGCMToken(app, tokens[index])
-					go dao.AddGCMToken(app, el.RegistrationID)
-				}
-			}
+		if err := checkToken(app, platform, token); err != nil {
+			log.Println("Register " + platform + ": " + err.Error())
+			renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": err.Code, "message": err.Message})
+			return
+		}
+		timezone, err := tokenTimezone(r)
+		if err != nil {
+			log.Println("Register " + platform + ": " + err.Error())
+			renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+			return
+		}
+		info, err := tokenInfo(r)
+		if err != nil {
+			log.Println("Register " + platform + ": " + err.Error())
+			renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+			return
 		}
+		log.Println("Register " + platform + " token: " + logged)
+		if err := saveRegistration(r, platform, app, token, timezone, info); err != nil {
+			log.Println("Register " + platform + ": " + err.Error())
+			renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+			return
+		}
+		renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Token saved"})
 	}
-
-	t2 := time.Now()
-	duration := t2.Sub(t1)
-	web_logs.GCMLogs("Request " + strconv.Itoa(reqNumber) + " sent to " + strconv.Itoa(len(toks)) + " devices in " + duration.String())
-	log.Println("Request " + strconv.Itoa(reqNumber) + " sent to " + strconv.Itoa(len(toks)) + " devices in " + duration.String())
-	wg.Done()
 }
 
-func sendApns(params map[string]interface{}) {
-	app := params["app"].(string)
-	appSettings, appError := getAppConfig(app)
-	if appError != nil {
-		return
-	}
-
-	c, err := apns.NewClientWithFiles(apns.ProductionGateway, appSettings.ApnsCert, appSettings.ApnsKey)
-	if err != nil {
-		fmt.Errorf("could not create new client", err.Error())
-		web_logs.APNSLogs("Could not create new client")
-		return
-	}
-
-	go func() {
-		for f := range c.FailedNotifs {
-			fmt.Println("Notif", f.Notif.ID, "failed with", f.Err.Error())
-			web_logs.APNSLogs("Error with token " + f.Notif.DeviceToken + ", removed from database")
-			dao.RemoveAPNSToken(app, f.Notif.DeviceToken)
+// unregisterHandler returns the handler removing the devices of a platform.
+func unregisterHandler(platform string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		app, token, logged, ok := readToken(w, r, platform, "Unregister")
+		if !ok {
+			return
 		}
-	}()
-
-	tokens := dao.GetAPNSTokens(params["app"].(string))
-
-	web_logs.APNSLogs("Broadcasting to " + strconv.Itoa(len(tokens)) + " devices")
-	for i := 0; i < len(tokens); i = i + 1 {
-		p := apns.NewPayload()
-		p.APS.Alert.Body = params["message"].(string)
-		p.APS.Sound = "bingbong.aiff"
-		p.APS.ContentAvailable = 1
-		for key, value := range params {
-			p.SetCustomValue(key, value)
+		log.Println("Unregister " + platform + " token: " + logged)
+		if err := store.RemoveToken(platform, app, token); err != nil {
+			log.Println("Unregister " + platform + ": " + err.Error())
+			renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+			return
 		}
-
-		m := apns.NewNotification()
-		m.Payload = p
-		m.DeviceToken = tokens[i]
-		m.Priority = apns.PriorityImmediate
-		m.Identifier = 25167       // Integer for APNS
-		m.ID = "user_id:timestamp" // ID not sent to Apple – to identify error notifications
-
-		c.Send(m)
+		renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Token deleted"})
 	}
-	web_logs.APNSLogs("Sent to " + strconv.Itoa(len(tokens)) + " devices")
-
 }
 
-func apnsFeedback(params map[string]interface{}) {
-	app := params["app"].(string)
-	appSettings, appError := getAppConfig(app)
-	if appError != nil {
-		return
+// readToken reads the app and the token params of a registration, and
+// answers the request when one is missing. A Web Push device sends the JSON
+// of its PushSubscription as subscription param, stored normalized and
+// logged by its endpoint so that its keys stay out of the log.
+func readToken(w http.ResponseWriter, r *http.Request, platform string, action string) (app string, token string, logged string, ok bool) {
+	param := "token"
+	if platform == dao.WebPush {
+		param = "subscription"
+	}
+	app = r.PostFormValue("app")
+	token = r.PostFormValue(param)
+	if token == "" || app == "" {
+		log.Println(action + " " + platform + ": app or " + param + " empty")
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "app and " + param + " params are required"})
+		return "", "", "", false
 	}
-
-	f, err := apns.NewFeedback(apns.ProductionFeedbackGateway, appSettings.ApnsCert, appSettings.ApnsKey)
-	if err != nil {
-		log.Fatal("Could not create feedback", err.Error())
+	if platform != dao.WebPush {
+		return app, token, token, true
 	}
 
-	for ft := range f.Receive() {
-		fmt.Println("Feedback for token:", ft.DeviceToken)
+	sub, err := webpush.ParseSubscription(token)
+	if err != nil {
+		log.Println(action + " " + platform + ": " + err.Error())
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "code": tokencheck.CodeFormat, "message": err.Error()})
+		return "", "", "", false
 	}
+	return app, sub.String(), sub.Endpoint, true
 }
 
-func sendApnsSandbox(params map[string]interface{}) {
-	app := params["app"].(string)
-	appSettings, appError := getAppConfig(app)
-	if appError != nil {
-		return
+// saveRegistration registers a token with its metadata and timezone, and
+// the tags and user when the request has these params.
+func saveRegistration(r *http.Request, platform string, app string, token string, timezone string, info dao.TokenInfo) error {
+	if err := store.RegisterToken(platform, app, token, info); err != nil {
+		return err
 	}
-
-	c, err := apns.NewClientWithFiles(apns.SandboxGateway, appSettings.ApnsCertSandbox, appSettings.ApnsKeySandbox)
-	if err != nil {
-		fmt.Errorf("could not create new client", err.Error())
-		web_logs.APNSLogs("Could not create new client")
-		return
-	}
-
-	//todo reuse code from sendApns()
-
-	go func() {
-		for f := range c.FailedNotifs {
-			fmt.Println("Notif", f.Notif.ID, "failed with", f.Err.Error())
-			web_logs.APNSLogs("Error with token " + f.Notif.DeviceToken + ", removed from database")
-			dao.RemoveAPNSToken(app, f.Notif.DeviceToken)
+	if timezone != "" {
+		if err := store.SetTokenTimezone(platform, app, token, timezone); err != nil {
+			return err
 		}
-	}()
-
-	tokens := dao.GetAPNSSandboxTokens(params["app"].(string))
-
-	web_logs.APNSLogs("Broadcasting to " + strconv.Itoa(len(tokens)) + " devices")
-	for i := 0; i < len(tokens); i = i + 1 {
-		p := apns.NewPayload()
-		p.APS.Alert.Body = params["message"].(string)
-		p.APS.Sound = "bingbong.aiff"
-		p.APS.ContentAvailable = 1
-		for key, value := range params {
-			p.SetCustomValue(key, value)
+	}
+	if _, ok := r.PostForm["tags"]; ok {
+		if err := store.SetTokenTags(platform, app, token, strings.Split(r.PostFormValue("tags"), ",")); err != nil {
+			return err
 		}
-
-		m := apns.NewNotification()
-		m.Payload = p
-		m.DeviceToken = tokens[i]
-		m.Priority = apns.PriorityImmediate
-		m.Identifier = 25167       // Integer for APNS
-		m.ID = "user_id:timestamp" // ID not sent to Apple – to identify error notifications
-
-		c.Send(m)
 	}
-	web_logs.APNSLogs("Sent to " + strconv.Itoa(len(tokens)) + " devices")
+	if _, ok := r.PostForm["user_id"]; ok {
+		return store.SetTokenUser(platform, app, token, r.PostFormValue("user_id"))
+	}
+	return nil
 }
 
-func apnsFeedbackSandbox(params map[string]interface{}) {
-	app := params["app"].(string)
-	appSettings, appError := getAppConfig(app)
-	if appError != nil {
-		return
+// tokenTimezone reads the optional IANA timezone of a registration.
+func tokenTimezone(r *http.Request) (string, error) {
+	timezone := r.PostFormValue("timezone")
+	if timezone == "" {
+		return "", nil
 	}
-
-	f, err := apns.NewFeedback(apns.SandboxFeedbackGateway, appSettings.ApnsCert, appSettings.ApnsKey)
-	if err != nil {
-		log.Fatal("Could not create feedback", err.Error())
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return "", errors.New("timezone must be an IANA timezone such as Europe/Paris")
 	}
+	return timezone, nil
+}
 
-	for ft := range f.Receive() {
-		fmt.Println("Feedback for token:", ft.DeviceToken)
+// tokenInfo reads the optional device metadata of a registration. The
+// custom param is a JSON object of string values.
+func tokenInfo(r *http.Request) (dao.TokenInfo, error) {
+	info := dao.TokenInfo{
+		AppVersion:  r.PostFormValue("app_version"),
+		OSVersion:   r.PostFormValue("os_version"),
+		Locale:      r.PostFormValue("locale"),
+		DeviceModel: r.PostFormValue("device_model"),
+	}
+	if custom := r.PostFormValue("custom"); custom != "" {
+		if err := json.Unmarshal([]byte(custom), &info.Custom); err != nil {
+			return info, errors.New("custom must be a JSON object of strings")
+		}
 	}
+	return info, nil
 }
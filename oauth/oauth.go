@@ -0,0 +1,82 @@
+// Package oauth caches the OAuth2 access tokens the providers authenticate
+// their requests with.
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// TokenSource caches an access token. Its zero value holds none.
+type TokenSource struct {
+	lock   sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// Token returns the cached access token, or the one requested by fetch
+// with its lifetime when the cached token is missing or about to expire.
+func (s *TokenSource) Token(fetch func() (string, time.Duration, error)) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.token != "" && time.Now().Before(s.expiry) {
+		return s.token, nil
+	}
+	token, lifetime, err := fetch()
+	if err != nil {
+		return "", err
+	}
+
+	s.token = token
+	s.expiry = time.Now().Add(lifetime - renewalMargin(lifetime))
+	return s.token, nil
+}
+
+// renewalMargin is how early a token of lifetime is renewed, so that the
+// requests in flight never carry an expired one: a minute, at most a
+// quarter of the lifetime for the short-lived tokens.
+func renewalMargin(lifetime time.Duration) time.Duration {
+	if margin := lifetime / 4; margin < time.Minute {
+		return margin
+	}
+	return time.Minute
+}
+
+// Reset forgets the cached token, after the provider refused it.
+func (s *TokenSource) Reset() {
+	s.lock.Lock()
+	s.token = ""
+	s.lock.Unlock()
+}
+
+// RequestToken posts form to the token endpoint at tokenURL and returns the
+// access token of its answer with its lifetime.
+func RequestToken(client *http.Client, tokenURL string, form url.Values) (string, time.Duration, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.PostForm(tokenURL, form)
+	if err != nil {
+		return "", 0, fmt.Errorf("requesting access token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		AccessToken      string          `json:"access_token"`
+		ExpiresIn        int             `json:"expires_in"`
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, fmt.Errorf("decoding access token: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return "", 0, fmt.Errorf("access token refused (HTTP %d): %s %s", resp.StatusCode, token.Error, token.ErrorDescription)
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
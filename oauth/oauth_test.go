@@ -0,0 +1,62 @@
+package oauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTokenSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"access","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	fetches := 0
+	var source TokenSource
+	fetch := func() (string, time.Duration, error) {
+		fetches++
+		return RequestToken(nil, server.URL, url.Values{"client_secret": {"secret"}})
+	}
+	for i := 0; i < 2; i++ {
+		if token, err := source.Token(fetch); token != "access" || err != nil {
+			t.Fatalf("Token() = %v, %v, want access", token, err)
+		}
+	}
+	source.Reset()
+	source.Token(fetch)
+	if fetches != 2 {
+		t.Errorf("fetches = %v, want %v", fetches, 2)
+	}
+
+	if _, _, err := RequestToken(nil, server.URL, url.Values{"client_secret": {"wrong"}}); err == nil {
+		t.Error("RequestToken() with a wrong secret should fail")
+	}
+}
+
+func TestShortLivedToken(t *testing.T) {
+	fetches := 0
+	var source TokenSource
+	fetch := func() (string, time.Duration, error) {
+		fetches++
+		return "access", 40 * time.Second, nil
+	}
+	source.Token(fetch)
+	source.Token(fetch)
+	if fetches != 1 {
+		t.Errorf("fetches = %v, want the token of 40s cached", fetches)
+	}
+	if margin := renewalMargin(40 * time.Second); margin != 10*time.Second {
+		t.Errorf("renewalMargin(40s) = %v, want %v", margin, 10*time.Second)
+	}
+	if margin := renewalMargin(time.Hour); margin != time.Minute {
+		t.Errorf("renewalMargin(1h) = %v, want %v", margin, time.Minute)
+	}
+}
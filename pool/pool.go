@@ -0,0 +1,30 @@
+// Package pool runs the sends of the providers concurrently, one message
+// per token.
+package pool
+
+import "sync"
+
+// DefaultWorkers is the number of concurrent sends when none is set.
+const DefaultWorkers = 16
+
+// Run calls send(i) for every i below n, workers calls at a time, and
+// returns once every call has returned. A workers of 0 or less runs
+// DefaultWorkers calls at a time.
+func Run(n int, workers int, send func(i int)) {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			send(i)
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,30 @@
+package pool
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	var running, max int32
+	done := make([]bool, 50)
+	Run(len(done), 4, func(i int) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		done[i] = true
+		atomic.AddInt32(&running, -1)
+	})
+	for i, ok := range done {
+		if !ok {
+			t.Fatalf("send(%d) not called", i)
+		}
+	}
+	if max > 4 {
+		t.Errorf("%d concurrent sends, want at most 4", max)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"mobile-push-broadcaster/adm"
+	"mobile-push-broadcaster/apns"
+	"mobile-push-broadcaster/dao"
+	"mobile-push-broadcaster/fcm"
+	"mobile-push-broadcaster/hms"
+	"mobile-push-broadcaster/push"
+	"mobile-push-broadcaster/web_logs"
+	"mobile-push-broadcaster/webpush"
+)
+
+// broadcastLogs writes the progress of a broadcast to the server log and to
+// the web socket of its platform, the Web Push, HMS and ADM have none.
+func broadcastLogs(platform string, line string) {
+	log.Println(line)
+	switch platform {
+	case dao.GCM:
+		web_logs.GCMLogs(line)
+	case dao.APNS, dao.APNSSandbox:
+		web_logs.APNSLogs(line)
+	}
+}
+
+// failed returns the same error as the result of every token.
+func failed(tokens []string, err error) []push.Result {
+	results := make([]push.Result, len(tokens))
+	for i, token := range tokens {
+		results[i] = push.Result{Token: token, Err: err}
+	}
+	return results
+}
+
+// senderCache keeps the sender of every app, created on first use so that
+// its access token is cached between broadcasts.
+type senderCache[S any] struct {
+	lock    sync.Mutex
+	senders map[string]S
+	create  func(appSettings appSettings) (S, error)
+}
+
+// get returns the sender of an app, creating it from the app settings when
+// the app has none yet.
+func (c *senderCache[S]) get(app string) (S, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if sender, ok := c.senders[app]; ok {
+		return sender, nil
+	}
+
+	var sender S
+	appSettings, err := getAppConfig(app)
+	if err != nil {
+		return sender, err
+	}
+	sender, err = c.create(appSettings)
+	if err != nil {
+		return sender, err
+	}
+	if c.senders == nil {
+		c.senders = make(map[string]S)
+	}
+	c.senders[app] = sender
+	return sender, nil
+}
+
+// fcmProvider sends Android notifications through FCM.
+type fcmProvider struct{}
+
+func (fcmProvider) Name() string {
+	return "FCM"
+}
+
+func (fcmProvider) Capabilities() push.Capabilities {
+	return push.Capabilities{MaxBatch: 1000}
+}
+
+func (fcmProvider) Send(msg push.Message, tokens []string) []push.Result {
+	sender, err := fcmSenders.get(msg.App)
+	if err != nil {
+		return failed(tokens, err)
+	}
+	results := make([]push.Result, len(tokens))
+
+	for i, result := range sender.Send(msg.Data, tokens) {
+		results[i] = push.Result{Token: result.Token, Err: result.Err, Unregistered: result.Unregistered()}
+	}
+	return results
+}
+
+// fcmSenders keeps the FCM sender of every app.
+var fcmSenders = &senderCache[*fcm.Sender]{create: func(appSettings appSettings) (*fcm.Sender, error) {
+	if appSettings.FcmCredentials == "" {
+		return nil, errors.New("No fcm_service_account configured for the app: " + appSettings.Name)
+	}
+	account, err := fcm.LoadServiceAccount(appSettings.FcmCredentials)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := fcm.NewSender(account)
+	if err != nil {
+		return nil, err
+	}
+	sender.Endpoint = settings.FcmEndpoint
+	sender.TokenURL = settings.FcmTokenEndpoint
+	return sender, nil
+}}
+
+// hmsProvider sends Android notifications to the Huawei devices through HMS
+// Push Kit.
+type hmsProvider struct{}
+
+func (hmsProvider) Name() string {
+	return "HMS"
+}
+
+func (hmsProvider) Capabilities() push.Capabilities {
+	return push.Capabilities{MaxBatch: hms.MaxTokens}
+}
+
+func (hmsProvider) Send(msg push.Message, tokens []string) []push.Result {
+	sender, err := hmsSenders.get(msg.App)
+	if err != nil {
+		return failed(tokens, err)
+	}
+	results := make([]push.Result, len(tokens))
+
+	for i, result := range sender.Send(msg.Data, tokens) {
+		results[i] = push.Result{Token: result.Token, Err: result.Err, Unregistered: result.Unregistered()}
+	}
+	return results
+}
+
+// hmsSenders keeps the HMS sender of every app.
+var hmsSenders = &senderCache[*hms.Sender]{create: func(appSettings appSettings) (*hms.Sender, error) {
+	if appSettings.HmsAppID == "" || appSettings.HmsAppSecret == "" {
+		return nil, errors.New("No hms_app_id or hms_app_secret configured for the app: " + appSettings.Name)
+	}
+	sender := hms.NewSender(appSettings.HmsAppID, appSettings.HmsAppSecret)
+	sender.Endpoint = settings.HmsEndpoint
+	sender.TokenURL = settings.HmsTokenEndpoint
+	return sender, nil
+}}
+
+// admProvider sends notifications to the Fire devices through ADM. The
+// registration IDs renewed by ADM are replaced by their canonical ID.
+type admProvider struct{}
+
+func (admProvider) Name() string {
+	return "ADM"
+}
+
+func (admProvider) Capabilities() push.Capabilities {
+	return push.Capabilities{MaxBatch: 1000, CanonicalIDs: true}
+}
+
+func (admProvider) Send(msg push.Message, tokens []string) []push.Result {
+	sender, err := admSenders.get(msg.App)
+	if err != nil {
+		return failed(tokens, err)
+	}
+	results := make([]push.Result, len(tokens))
+
+	for i, result := range sender.Send(msg.Data, tokens) {
+		results[i] = push.Result{Token: result.Token, Err: result.Err, Unregistered: result.Unregistered(), CanonicalID: result.CanonicalID()}
+	}
+	return results
+}
+
+// admSenders keeps the ADM sender of every app.
+var admSenders = &senderCache[*adm.Sender]{create: func(appSettings appSettings) (*adm.Sender, error) {
+	if appSettings.AdmClientID == "" || appSettings.AdmClientSecret == "" {
+		return nil, errors.New("No adm_client_id or adm_client_secret configured for the app: " + appSettings.Name)
+	}
+	sender := adm.NewSender(appSettings.AdmClientID, appSettings.AdmClientSecret)
+	sender.Endpoint = settings.AdmEndpoint
+	sender.TokenURL = settings.AdmTokenEndpoint
+	return sender, nil
+}}
+
+// apnsProvider sends iOS notifications through APNS, or its sandbox.
+type apnsProvider struct {
+	sandbox bool
+}
+
+func (p apnsProvider) Name() string {
+	if p.sandbox {
+		return "APNS Sandbox"
+	}
+	return "APNS"
+}
+
+func (apnsProvider) Capabilities() push.Capabilities {
+	return push.Capabilities{MaxBatch: 1000}
+}
+
+func (p apnsProvider) Send(msg push.Message, tokens []string) []push.Result {
+	appSettings, err := getAppConfig(msg.App)
+	if err != nil {
+		return failed(tokens, err)
+	}
+	c, err := getApnsClient(appSettings, p.sandbox)
+	if err != nil {
+		return failed(tokens, errors.New("Could not create APNS client: "+err.Error()))
+	}
+	payload, err := apnsPayload(msg.Data)
+	if err != nil {
+		return failed(tokens, err)
+	}
+
+	n := &apns.Notification{
+		Topic:    appSettings.ApnsTopic,
+		Priority: apns.PriorityImmediate,
+		Payload:  payload,
+	}
+	if appSettings.ApnsExpiration > 0 {
+		n.Expiration = time.Now().Add(time.Duration(appSettings.ApnsExpiration) * time.Second)
+	}
+
+	results := make([]push.Result, len(tokens))
+	for i, resp := range c.Send(n, tokens) {
+		results[i] = push.Result{Token: resp.DeviceToken, Err: resp.Err, Unregistered: resp.Unregistered()}
+	}
+	return results
+}
+
+// apnsPayload builds the JSON payload of a broadcast: the message as alert
+// body plus every broadcast param as custom value.
+func apnsPayload(params map[string]string) ([]byte, error) {
+	payload := make(map[string]interface{})
+	for key, value := range params {
+		payload[key] = value
+	}
+	payload["aps"] = map[string]interface{}{
+		"alert":             map[string]interface{}{"body": params["message"]},
+		"sound":             "bingbong.aiff",
+		"content-available": 1,
+	}
+	return json.Marshal(payload)
+}
+
+var apnsClients = make(map[string]*apns.Client)
+var apnsClientsLock sync.Mutex
+
+// getApnsClient returns the APNS client of an app, creating it on first use.
+// Token authentication is used when the app has an apns_auth_key, otherwise
+// the client certificate of the environment.
+func getApnsClient(appSettings appSettings, sandbox bool) (*apns.Client, error) {
+	host := apns.ProductionHost
+	if settings.ApnsHost != "" {
+		host = settings.ApnsHost
+	}
+	certFile, keyFile := appSettings.ApnsCert, appSettings.ApnsKey
+	if sandbox {
+		host = apns.SandboxHost
+		if settings.ApnsSandboxHost != "" {
+			host = settings.ApnsSandboxHost
+		}
+		certFile, keyFile = appSettings.ApnsCertSandbox, appSettings.ApnsKeySandbox
+	}
+
+	// The sandbox flag keeps the clients apart when both hosts are the same.
+	key := host + "#" + appSettings.Name + "#" + strconv.FormatBool(sandbox)
+	apnsClientsLock.Lock()
+	defer apnsClientsLock.Unlock()
+	if c, ok := apnsClients[key]; ok {
+		return c, nil
+	}
+
+	var c *apns.Client
+	if appSettings.ApnsAuthKey != "" {
+		authKey, err := apns.LoadAuthKey(appSettings.ApnsAuthKey)
+		if err != nil {
+			return nil, err
+		}
+		c = apns.NewTokenClient(host, apns.NewToken(appSettings.ApnsTeamID, appSettings.ApnsKeyID, authKey))
+	} else {
+		var err error
+		c, err = apns.NewCertificateClient(host, certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	apnsClients[key] = c
+	return c, nil
+}
+
+// webPushProvider sends browser notifications with the Web Push protocol,
+// the params of the broadcast as a JSON object.
+type webPushProvider struct{}
+
+func (webPushProvider) Name() string {
+	return "Web Push"
+}
+
+func (webPushProvider) Capabilities() push.Capabilities {
+	return push.Capabilities{MaxBatch: 1000}
+}
+
+func (webPushProvider) Send(msg push.Message, tokens []string) []push.Result {
+	sender, err := webPushSenders.get(msg.App)
+	if err != nil {
+		return failed(tokens, err)
+	}
+	payload, err := json.Marshal(msg.Data)
+	if err != nil {
+		return failed(tokens, err)
+	}
+
+	results := make([]push.Result, len(tokens))
+	for i, result := range sender.Send(payload, tokens) {
+		results[i] = push.Result{Token: result.Token, Err: result.Err, Unregistered: result.Unregistered()}
+	}
+	return results
+}
+
+// webPushSenders keeps the Web Push sender of every app, whose VAPID JWTs
+// are cached between broadcasts.
+var webPushSenders = &senderCache[*webpush.Sender]{create: func(appSettings appSettings) (*webpush.Sender, error) {
+	if appSettings.VapidPrivateKey == "" {
+		return nil, errors.New("No vapid_private_key configured for the app: " + appSettings.Name)
+	}
+	vapid, err := webpush.NewVAPID(appSettings.VapidPublicKey, appSettings.VapidPrivateKey, appSettings.VapidSubject)
+	if err != nil {
+		return nil, err
+	}
+	return &webpush.Sender{VAPID: vapid}, nil
+}}
@@ -0,0 +1,72 @@
+package push
+
+import (
+	"errors"
+	"sync"
+)
+
+// Delivery is a message received by a Fake provider.
+type Delivery struct {
+	Token   string
+	Message Message
+}
+
+// Fake is an in-memory provider to exercise the broadcast flow without
+// talking to Google or Apple. Tokens listed in Unregistered are rejected,
+// tokens in Failing fail without being removed and tokens in Canonical are
+// delivered and replaced by their mapped value.
+type Fake struct {
+	FakeName     string
+	MaxBatch     int
+	Unregistered map[string]bool
+	Failing      map[string]bool
+	Canonical    map[string]string
+
+	lock       sync.Mutex
+	deliveries []Delivery
+}
+
+func NewFake(name string) *Fake {
+	return &Fake{
+		FakeName:     name,
+		Unregistered: make(map[string]bool),
+		Failing:      make(map[string]bool),
+		Canonical:    make(map[string]string),
+	}
+}
+
+func (f *Fake) Name() string {
+	return f.FakeName
+}
+
+func (f *Fake) Capabilities() Capabilities {
+	return Capabilities{MaxBatch: f.MaxBatch, CanonicalIDs: true}
+}
+
+func (f *Fake) Send(msg Message, tokens []string) []Result {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	results := make([]Result, len(tokens))
+	for i, token := range tokens {
+		results[i].Token = token
+		switch {
+		case f.Unregistered[token]:
+			results[i].Err = errors.New("unregistered")
+			results[i].Unregistered = true
+		case f.Failing[token]:
+			results[i].Err = errors.New("unavailable")
+		default:
+			results[i].CanonicalID = f.Canonical[token]
+			f.deliveries = append(f.deliveries, Delivery{token, msg})
+		}
+	}
+	return results
+}
+
+// Deliveries returns the messages delivered so far.
+func (f *Fake) Deliveries() []Delivery {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]Delivery(nil), f.deliveries...)
+}
@@ -0,0 +1,257 @@
+// Package push runs broadcasts against pluggable push providers.
+//
+// A Provider knows how to deliver a message to the tokens of one platform
+// (GCM/FCM, APNS, APNS sandbox...). The Broadcaster reads the tokens of an
+// app from a TokenStore, hands them to the provider in batches and feeds
+// the provider's verdicts back into the store.
+package push
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Message is the payload broadcast to the devices of an app.
+type Message struct {
+	App  string
+	Data map[string]string
+}
+
+// Result is the outcome of a message sent to one token.
+type Result struct {
+	Token string
+	Err   error
+	// Unregistered is set when the provider rejected the token itself,
+	// which is then removed from the store.
+	Unregistered bool
+	// CanonicalID is the token that replaces Token, when the provider
+	// reports one.
+	CanonicalID string
+}
+
+// Capabilities describes what a provider supports.
+type Capabilities struct {
+	// MaxBatch is the number of tokens handed to one Send call, 0 for
+	// no limit.
+	MaxBatch int
+	// CanonicalIDs is set when the provider may report replacement tokens.
+	CanonicalIDs bool
+}
+
+// Provider delivers messages to the devices of one platform.
+type Provider interface {
+	// Name is the human readable name used in the logs.
+	Name() string
+	Capabilities() Capabilities
+	// Send delivers msg to every token and returns one result per token.
+	Send(msg Message, tokens []string) []Result
+}
+
+// TokenStore gives access to the registered tokens of each platform. The
+// errors are those of the persistence of the changes.
+type TokenStore interface {
+	GetTokens(platform string, app string) []string
+	// ForEachTokenPage calls fn with the tokens of an app, size at a
+	// time, until fn returns an error.
+	ForEachTokenPage(platform string, app string, size int, fn func(tokens []string) error) error
+	AddToken(platform string, app string, token string) error
+	RemoveToken(platform string, app string, token string) error
+	// CleanTokens removes the removed tokens and swaps the keys of
+	// replaced for their canonical ID, at once.
+	CleanTokens(platform string, app string, removed []string, replaced map[string]string) error
+}
+
+// Registry maps platforms to their provider.
+type Registry struct {
+	lock      sync.RWMutex
+	providers map[string]Provider
+}
+
+func NewRegistry() *Registry {
+	return &Registry{providers: make(map[string]Provider)}
+}
+
+// Register sets the provider of a platform, replacing any previous one.
+func (r *Registry) Register(platform string, p Provider) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.providers[platform] = p
+}
+
+func (r *Registry) Get(platform string) (Provider, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	p, ok := r.providers[platform]
+	return p, ok
+}
+
+// Platforms returns the registered platforms in alphabetical order.
+func (r *Registry) Platforms() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	platforms := make([]string, 0, len(r.providers))
+	for platform := range r.providers {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	return platforms
+}
+
+// Report sums up the outcome of a broadcast on one platform.
+type Report struct {
+	Platform  string        `json:"platform"`
+	Tokens    int           `json:"tokens"`
+	Sent      int           `json:"sent"`
+	Failed    int           `json:"failed"`
+	Removed   int           `json:"removed"`
+	Canonical int           `json:"canonical_ids"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// DefaultPageSize is the number of tokens read at a time by a broadcast.
+const DefaultPageSize = 10000
+
+// Broadcaster sends messages through the providers of a registry.
+type Broadcaster struct {
+	Providers *Registry
+	Tokens    TokenStore
+	// PageSize is the number of tokens read at a time by Broadcast,
+	// DefaultPageSize when 0.
+	PageSize int
+	// Logs receives the progress of the broadcasts, it may be nil.
+	Logs func(platform string, line string)
+}
+
+// Broadcast sends msg to every token of the app on platform. The tokens
+// are read and sent a page at a time, the tokens registered during the
+// broadcast may be missed.
+func (b *Broadcaster) Broadcast(platform string, msg Message) (Report, error) {
+	return b.BroadcastSelect(platform, msg, nil)
+}
+
+// BroadcastSelect is like Broadcast, sending only to the tokens of each
+// page kept by selectTokens. A nil selectTokens keeps every token.
+func (b *Broadcaster) BroadcastSelect(platform string, msg Message, selectTokens func(tokens []string) []string) (Report, error) {
+	report := Report{Platform: platform}
+	if _, ok := b.Providers.Get(platform); !ok {
+		return report, errors.New("No provider for the platform: " + platform)
+	}
+	size := b.PageSize
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+
+	t1 := time.Now()
+	err := b.Tokens.ForEachTokenPage(platform, msg.App, size, func(tokens []string) error {
+		if selectTokens != nil {
+			tokens = selectTokens(tokens)
+		}
+		if len(tokens) == 0 {
+			return nil
+		}
+		page, err := b.SendTo(platform, msg, tokens)
+		report.Tokens += page.Tokens
+		report.Sent += page.Sent
+		report.Failed += page.Failed
+		report.Removed += page.Removed
+		report.Canonical += page.Canonical
+		return err
+	})
+	report.Duration = time.Since(t1)
+	return report, err
+}
+
+// SendTo sends msg to the given tokens of platform. Batches are sent
+// concurrently and tokens rejected by the provider are removed from the
+// store, or replaced by their canonical ID.
+func (b *Broadcaster) SendTo(platform string, msg Message, tokens []string) (Report, error) {
+	report, _, err := b.SendResults(platform, msg, tokens)
+	return report, err
+}
+
+// SendResults is like SendTo and also returns the result of each token, in
+// the order of tokens.
+func (b *Broadcaster) SendResults(platform string, msg Message, tokens []string) (Report, []Result, error) {
+	report := Report{Platform: platform, Tokens: len(tokens)}
+	provider, ok := b.Providers.Get(platform)
+	if !ok {
+		return report, nil, errors.New("No provider for the platform: " + platform)
+	}
+
+	t1 := time.Now()
+	batch := provider.Capabilities().MaxBatch
+	if batch <= 0 {
+		batch = len(tokens)
+	}
+
+	results := make([]Result, len(tokens))
+	var wg sync.WaitGroup
+	var reportLock sync.Mutex
+	var reqNumber int
+	for i := 0; i < len(tokens); i = i + batch {
+		max := i + batch
+		if max >= len(tokens) {
+			max = len(tokens)
+		}
+		reqNumber = reqNumber + 1
+		b.log(platform, "Send request "+strconv.Itoa(reqNumber)+" to the "+provider.Name()+" server")
+		wg.Add(1)
+		go func(toks []string, batchResults []Result, reqNumber int) {
+			defer wg.Done()
+			t1 := time.Now()
+			copy(batchResults, provider.Send(msg, toks))
+
+			reportLock.Lock()
+			removed, replaced := b.handleResults(platform, batchResults, &report)
+			reportLock.Unlock()
+			if len(removed) > 0 || len(replaced) > 0 {
+				if err := b.Tokens.CleanTokens(platform, msg.App, removed, replaced); err != nil {
+					b.log(platform, "Error cleaning the tokens of request "+strconv.Itoa(reqNumber)+": "+err.Error())
+				}
+			}
+			b.log(platform, "Request "+strconv.Itoa(reqNumber)+" sent to "+strconv.Itoa(len(toks))+" devices in "+time.Since(t1).String())
+		}(tokens[i:max], results[i:max], reqNumber)
+	}
+	wg.Wait()
+
+	report.Duration = time.Since(t1)
+	b.log(platform, "Notifications sent to "+strconv.Itoa(report.Sent)+" "+provider.Name()+" devices in "+report.Duration.String())
+	return report, results, nil
+}
+
+// handleResults counts the results of a batch in report, and returns the
+// tokens to remove and those to replace by their canonical ID.
+func (b *Broadcaster) handleResults(platform string, results []Result, report *Report) ([]string, map[string]string) {
+	var removed []string
+	var replaced map[string]string
+	for _, result := range results {
+		switch {
+		case result.Err == nil && result.CanonicalID == "":
+			report.Sent++
+		case result.CanonicalID != "":
+			report.Sent++
+			report.Canonical++
+			if replaced == nil {
+				replaced = make(map[string]string)
+			}
+			replaced[result.Token] = result.CanonicalID
+		default:
+			report.Failed++
+			b.log(platform, "Error with token "+result.Token+": "+result.Err.Error())
+			if result.Unregistered {
+				report.Removed++
+				removed = append(removed, result.Token)
+			}
+		}
+	}
+	return removed, replaced
+}
+
+func (b *Broadcaster) log(platform string, line string) {
+	if b.Logs != nil {
+		b.Logs(platform, line)
+	}
+}
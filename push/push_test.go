@@ -0,0 +1,106 @@
+package push
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+type memoryTokens struct {
+	lock   sync.Mutex
+	tokens map[string][]string
+}
+
+func (m *memoryTokens) GetTokens(platform string, app string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string(nil), m.tokens[platform+"#"+app]...)
+}
+
+func (m *memoryTokens) ForEachTokenPage(platform string, app string, size int, fn func(tokens []string) error) error {
+	tokens := m.GetTokens(platform, app)
+	for i := 0; i < len(tokens); i += size {
+		end := i + size
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		if err := fn(tokens[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memoryTokens) AddToken(platform string, app string, token string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.tokens[platform+"#"+app] = append(m.tokens[platform+"#"+app], token)
+	return nil
+}
+
+func (m *memoryTokens) RemoveToken(platform string, app string, token string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tokens := m.tokens[platform+"#"+app]
+	for i, element := range tokens {
+		if element == token {
+			m.tokens[platform+"#"+app] = append(tokens[:i], tokens[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *memoryTokens) CleanTokens(platform string, app string, removed []string, replaced map[string]string) error {
+	for _, token := range removed {
+		m.RemoveToken(platform, app, token)
+	}
+	for oldToken, newToken := range replaced {
+		m.RemoveToken(platform, app, oldToken)
+		m.AddToken(platform, app, newToken)
+	}
+	return nil
+}
+
+func TestBroadcast(t *testing.T) {
+	store := &memoryTokens{tokens: make(map[string][]string)}
+	for i := 0; i < 25; i++ {
+		store.AddToken("gcm", "App1", strconv.Itoa(i))
+	}
+	store.AddToken("apns", "App1", "ios")
+
+	fake := NewFake("Fake")
+	fake.MaxBatch = 10
+	fake.Unregistered["3"] = true
+	fake.Failing["4"] = true
+	fake.Canonical["5"] = "new5"
+
+	registry := NewRegistry()
+	registry.Register("gcm", fake)
+	b := &Broadcaster{Providers: registry, Tokens: store, PageSize: 8}
+
+	report, err := b.Broadcast("gcm", Message{App: "App1", Data: map[string]string{"title": "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Report{Platform: "gcm", Tokens: 25, Sent: 23, Failed: 2, Removed: 1, Canonical: 1}
+	report.Duration = 0
+	if report != want {
+		t.Errorf("report = %+v, want %+v", report, want)
+	}
+	if len(fake.Deliveries()) != 23 {
+		t.Errorf("len(Deliveries()) = %v, want %v", len(fake.Deliveries()), 23)
+	}
+
+	registered := make(map[string]bool)
+	for _, token := range store.GetTokens("gcm", "App1") {
+		registered[token] = true
+	}
+	if len(registered) != 24 || registered["3"] || registered["5"] || !registered["new5"] {
+		t.Errorf("tokens = %v, want 3 removed and 5 replaced by new5", registered)
+	}
+
+	if _, err := b.Broadcast("apns", Message{App: "App1"}); err == nil {
+		t.Errorf("Broadcast() without provider, want an error")
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"mobile-push-broadcaster/cron"
+)
+
+const recurringBucket = "recurring"
+
+// recurringLock serializes the runs and the edits of recurring broadcasts.
+var recurringLock sync.Mutex
+
+// recurringBroadcast is a broadcast sent on a cron schedule. The values of
+// its payload are text/template templates rendered at each run, see
+// templateData.
+type recurringBroadcast struct {
+	ID        string            `json:"id"`
+	App       string            `json:"app"`
+	Cron      string            `json:"cron"`
+	Timezone  string            `json:"timezone"`
+	Payload   map[string]string `json:"payload"`
+	Platforms []string          `json:"platforms"`
+	Paused    bool              `json:"paused"`
+	Created   time.Time         `json:"created"`
+	NextRun   time.Time         `json:"next_run"`
+	LastRun   time.Time         `json:"last_run"`
+	LastJob   string            `json:"last_job"`
+}
+
+// templateData is given to the payload templates of a recurring broadcast.
+type templateData struct {
+	App     string
+	Now     time.Time
+	Date    string
+	Time    string
+	Weekday string
+}
+
+func (rb *recurringBroadcast) schedule() (*cron.Schedule, *time.Location, error) {
+	s, err := cron.Parse(rb.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	loc, err := time.LoadLocation(rb.Timezone)
+	if err != nil {
+		return nil, nil, errors.New("Unknown timezone: " + rb.Timezone)
+	}
+	return s, loc, nil
+}
+
+// nextRuns returns the next n activations after t.
+func (rb *recurringBroadcast) nextRuns(t time.Time, n int) ([]time.Time, error) {
+	s, loc, err := rb.schedule()
+	if err != nil {
+		return nil, err
+	}
+	var runs []time.Time
+	t = t.In(loc)
+	for i := 0; i < n; i++ {
+		if t, err = s.Next(t); err != nil {
+			return nil, err
+		}
+		runs = append(runs, t)
+	}
+	return runs, nil
+}
+
+// render executes the payload templates for a run at t.
+func (rb *recurringBroadcast) render(t time.Time) (map[string]string, error) {
+	data := templateData{
+		App:     rb.App,
+		Now:     t,
+		Date:    t.Format("2006-01-02"),
+		Time:    t.Format("15:04"),
+		Weekday: t.Weekday().String(),
+	}
+	payload := make(map[string]string)
+	for key, value := range rb.Payload {
+		tmpl, err := template.New(key).Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		payload[key] = buf.String()
+	}
+	return payload, nil
+}
+
+func (rb *recurringBroadcast) save() error {
+	data, err := json.Marshal(rb)
+	if err != nil {
+		return err
+	}
+	return store.PutRecord(recurringBucket, rb.ID, data)
+}
+
+func loadRecurring(id string) (*recurringBroadcast, error) {
+	data, err := store.GetRecord(recurringBucket, id)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var rb recurringBroadcast
+	if err := json.Unmarshal(data, &rb); err != nil {
+		return nil, err
+	}
+	return &rb, nil
+}
+
+// loadRecurrings returns the recurring broadcasts of an app, or of every
+// app when app is empty.
+func loadRecurrings(app string) ([]*recurringBroadcast, error) {
+	recurrings := []*recurringBroadcast{}
+	err := store.ForEachRecord(recurringBucket, func(key string, value []byte) error {
+		var rb recurringBroadcast
+		if err := json.Unmarshal(value, &rb); err != nil {
+			return err
+		}
+		if app == "" || rb.App == app {
+			recurrings = append(recurrings, &rb)
+		}
+		return nil
+	})
+	sort.Slice(recurrings, func(a, b int) bool { return recurrings[a].ID < recurrings[b].ID })
+	return recurrings, err
+}
+
+// scheduleRecurring registers the next run of a recurring broadcast.
+func scheduleRecurring(rb *recurringBroadcast) {
+	if rb.Paused || rb.NextRun.IsZero() {
+		jobScheduler.cancel("recurring#" + rb.ID)
+		return
+	}
+	id := rb.ID
+	jobScheduler.schedule("recurring#"+id, rb.NextRun, func() {
+		runRecurring(id)
+	})
+}
+
+// runRecurring starts a broadcast job for the current run of a recurring
+// broadcast and schedules the following run.
+func runRecurring(id string) {
+	recurringLock.Lock()
+	defer recurringLock.Unlock()
+
+	rb, err := loadRecurring(id)
+	if err != nil || rb == nil || rb.Paused {
+		if err != nil {
+			log.Println("Recurring broadcast " + id + " not loaded: " + err.Error())
+		}
+		return
+	}
+
+	now := time.Now()
+	payload, err := rb.render(now.In(rb.location()))
+	if err != nil {
+		log.Println("Recurring broadcast " + id + ": payload template: " + err.Error())
+	} else {
+		j := newJob(rb.App, payload, rb.Platforms)
+		if err := j.save(); err != nil {
+			log.Println("Recurring broadcast " + id + ": job not saved: " + err.Error())
+		} else {
+			go j.run()
+			rb.LastJob = j.ID
+		}
+	}
+	rb.LastRun = now
+
+	rb.NextRun = time.Time{}
+	if runs, err := rb.nextRuns(now, 1); err == nil {
+		rb.NextRun = runs[0]
+	}
+	if err := rb.save(); err != nil {
+		log.Println("Recurring broadcast " + id + " not saved: " + err.Error())
+	}
+	scheduleRecurring(rb)
+}
+
+func (rb *recurringBroadcast) location() *time.Location {
+	if loc, err := time.LoadLocation(rb.Timezone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// reloadRecurrings schedules the recurring broadcasts stored in the DB. A
+// run missed while the server was down is sent once at startup.
+func reloadRecurrings() error {
+	recurrings, err := loadRecurrings("")
+	if err != nil {
+		return err
+	}
+	for _, rb := range recurrings {
+		scheduleRecurring(rb)
+	}
+	return nil
+}
+
+// recurringParams reads a recurring broadcast definition from the same
+// params as /broadcast plus cron and timezone.
+func recurringParams(r *http.Request, rb *recurringBroadcast) error {
+	params, platforms := broadcastParams(r)
+	if params["cron"] != "" {
+		rb.Cron = params["cron"]
+	}
+	if params["timezone"] != "" {
+		rb.Timezone = params["timezone"]
+	}
+	if rb.Timezone == "" {
+		rb.Timezone = "UTC"
+	}
+	delete(params, "cron")
+	delete(params, "timezone")
+	// Every run is sent when due, the delivery params of /broadcast make
+	// no sense here.
+	for _, param := range []string{"delivery", "local_time", "send_at"} {
+		if params[param] != "" {
+			return errors.New(param + " cannot be used with a recurring broadcast")
+		}
+	}
+	if params["app"] != "" && rb.App != "" && params["app"] != rb.App {
+		return errors.New("The app of a recurring broadcast cannot change")
+	}
+	if rb.App == "" {
+		rb.App = params["app"]
+	}
+	if _, err := getAppConfig(rb.App); err != nil {
+		return err
+	}
+	params["app"] = rb.App
+	rb.Payload = params
+	rb.Platforms = platforms
+
+	// A run is rendered now to check the templates and the segment they
+	// give, which is parsed again at each run.
+	payload, err := rb.render(time.Now().In(rb.location()))
+	if err != nil {
+		return err
+	}
+	if err := checkBroadcastParams(payload); err != nil {
+		return err
+	}
+	runs, err := rb.nextRuns(time.Now(), 1)
+	if err != nil {
+		return err
+	}
+	rb.NextRun = runs[0]
+	return nil
+}
+
+func listRecurring(w http.ResponseWriter, r *http.Request) {
+	recurrings, err := loadRecurrings(r.URL.Query().Get("app"))
+	if err != nil {
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	renderer.JSON(w, http.StatusOK, recurrings)
+}
+
+func createRecurring(w http.ResponseWriter, r *http.Request) {
+	recurringLock.Lock()
+	defer recurringLock.Unlock()
+
+	rb := &recurringBroadcast{ID: newJobID(), Created: time.Now()}
+	if err := recurringParams(r, rb); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	if err := rb.save(); err != nil {
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	scheduleRecurring(rb)
+	renderer.JSON(w, http.StatusOK, rb)
+}
+
+// withRecurring loads the recurring broadcast of the request and passes it
+// to fn under the recurring lock.
+func withRecurring(fn func(w http.ResponseWriter, r *http.Request, rb *recurringBroadcast)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		recurringLock.Lock()
+		defer recurringLock.Unlock()
+
+		rb, err := loadRecurring(mux.Vars(r)["id"])
+		if err != nil {
+			renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+			return
+		}
+		if rb == nil {
+			renderer.JSON(w, http.StatusNotFound, map[string]string{"status": "error", "message": "No recurring broadcast with this id"})
+			return
+		}
+		fn(w, r, rb)
+	}
+}
+
+func getRecurring(w http.ResponseWriter, r *http.Request, rb *recurringBroadcast) {
+	renderer.JSON(w, http.StatusOK, rb)
+}
+
+func editRecurring(w http.ResponseWriter, r *http.Request, rb *recurringBroadcast) {
+	if err := recurringParams(r, rb); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	saveRecurring(w, rb)
+}
+
+func pauseRecurring(w http.ResponseWriter, r *http.Request, rb *recurringBroadcast) {
+	rb.Paused = true
+	rb.NextRun = time.Time{}
+	saveRecurring(w, rb)
+}
+
+func resumeRecurring(w http.ResponseWriter, r *http.Request, rb *recurringBroadcast) {
+	runs, err := rb.nextRuns(time.Now(), 1)
+	if err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	rb.Paused = false
+	rb.NextRun = runs[0]
+	saveRecurring(w, rb)
+}
+
+func saveRecurring(w http.ResponseWriter, rb *recurringBroadcast) {
+	if err := rb.save(); err != nil {
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	scheduleRecurring(rb)
+	renderer.JSON(w, http.StatusOK, rb)
+}
+
+func deleteRecurring(w http.ResponseWriter, r *http.Request, rb *recurringBroadcast) {
+	jobScheduler.cancel("recurring#" + rb.ID)
+	if err := store.DeleteRecord(recurringBucket, rb.ID); err != nil {
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Recurring broadcast deleted"})
+}
+
+// previewRecurring lists the next runs of a recurring broadcast, 5 unless
+// the count param says otherwise.
+func previewRecurring(w http.ResponseWriter, r *http.Request, rb *recurringBroadcast) {
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count <= 0 || count > 100 {
+		count = 5
+	}
+	runs, err := rb.nextRuns(time.Now(), count)
+	if err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{"paused": rb.Paused, "next_runs": runs})
+}
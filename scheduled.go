@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// scheduledJobsLock serializes the edits of scheduled jobs with their
+// release, so that an edit never overwrites a job that already started.
+var scheduledJobsLock sync.Mutex
+
+// parseSendAt reads a send_at param, given as RFC 3339 or as a Unix
+// timestamp in seconds.
+func parseSendAt(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("send_at must be an RFC 3339 date or a Unix timestamp")
+	}
+	return t, nil
+}
+
+// scheduleJob registers a scheduled job in the scheduler.
+func scheduleJob(j *job) {
+	id := j.ID
+	jobScheduler.schedule("job#"+id, j.SendAt, func() {
+		releaseScheduledJob(id)
+	})
+}
+
+// releaseScheduledJob starts a scheduled job, unless it was canceled or
+// already started since it was scheduled.
+func releaseScheduledJob(id string) {
+	scheduledJobsLock.Lock()
+	j, err := loadJob(id)
+	if err != nil || j == nil || j.Status != jobScheduled {
+		scheduledJobsLock.Unlock()
+		if err != nil {
+			log.Println("Scheduled job " + id + " not loaded: " + err.Error())
+		}
+		return
+	}
+	j.Status = jobPending
+	if err := j.save(); err != nil {
+		log.Println("Job " + id + " not saved: " + err.Error())
+	}
+	scheduledJobsLock.Unlock()
+
+	log.Println("Release scheduled job " + id)
+	j.run()
+}
+
+// reloadScheduledJobs schedules the jobs still pending in the DB, after a
+// restart. Jobs that came due while the server was down run immediately.
+// The broadcasts interrupted by the restart are marked failed, their
+// platforms without results never completed. The local-time jobs resume
+// in reloadLocalDeliveries.
+func reloadScheduledJobs() error {
+	jobs, err := loadJobs("")
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		switch {
+		case j.Status == jobScheduled:
+			scheduleJob(j)
+		case (j.Status == jobPending || j.Status == jobRunning) && j.Delivery != deliveryLocal:
+			for _, platform := range j.Platforms {
+				if j.Results[platform] == nil {
+					j.Errors[platform] = "Interrupted by a restart of the server"
+				}
+			}
+			j.Status = jobFailed
+			j.Ended = time.Now()
+			if err := j.save(); err != nil {
+				return err
+			}
+			log.Println("Job " + j.ID + " interrupted by the restart")
+		}
+	}
+	return nil
+}
+
+func listScheduled(w http.ResponseWriter, r *http.Request) {
+	jobs, err := loadJobs(r.URL.Query().Get("app"))
+	if err != nil {
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	scheduled := []*job{}
+	for _, j := range jobs {
+		if j.Status == jobScheduled {
+			scheduled = append(scheduled, j)
+		}
+	}
+	sort.Slice(scheduled, func(a, b int) bool { return scheduled[a].SendAt.Before(scheduled[b].SendAt) })
+	renderer.JSON(w, http.StatusOK, scheduled)
+}
+
+// editScheduled replaces the payload, platforms and send time of a pending
+// scheduled job. It takes the same params as /broadcast, checked the same
+// way.
+func editScheduled(w http.ResponseWriter, r *http.Request) {
+	params, platforms := broadcastParams(r)
+	if err := checkBroadcastParams(params); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	sendAt, err := parseSendAt(params["send_at"])
+	if err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	scheduledJobsLock.Lock()
+	defer scheduledJobsLock.Unlock()
+	j, status, err := loadScheduledJob(mux.Vars(r)["id"])
+	if err != nil {
+		renderer.JSON(w, status, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	if params["app"] != "" && params["app"] != j.App {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "The app of a scheduled broadcast cannot change"})
+		return
+	}
+
+	params["app"] = j.App
+	j.Payload = params
+	j.Platforms = platforms
+	j.SendAt = sendAt
+	if err := j.save(); err != nil {
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	scheduleJob(j)
+	renderer.JSON(w, http.StatusOK, j)
+}
+
+// cancelScheduled cancels a scheduled job, or the cohorts not sent yet of
+// a job delivered in local time.
+func cancelScheduled(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if j, err := loadJob(id); err == nil && j != nil && j.Delivery == deliveryLocal {
+		if status, err := cancelLocalDelivery(id); err != nil {
+			renderer.JSON(w, status, map[string]string{"status": "error", "message": err.Error()})
+			return
+		}
+		renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Broadcast canceled"})
+		return
+	}
+
+	scheduledJobsLock.Lock()
+	defer scheduledJobsLock.Unlock()
+	j, status, err := loadScheduledJob(id)
+	if err != nil {
+		renderer.JSON(w, status, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	jobScheduler.cancel("job#" + j.ID)
+	j.Status = jobCanceled
+	j.Ended = time.Now()
+	if err := j.save(); err != nil {
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	renderer.JSON(w, http.StatusOK, map[string]string{"status": "success", "message": "Broadcast canceled"})
+}
+
+// loadScheduledJob loads a job that is still waiting for its send time,
+// returning the HTTP status to report when it cannot be edited.
+func loadScheduledJob(id string) (*job, int, error) {
+	j, err := loadJob(id)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if j == nil {
+		return nil, http.StatusNotFound, errors.New("No job with this id")
+	}
+	if j.Status != jobScheduled {
+		return nil, http.StatusConflict, errors.New("The job is " + j.Status + ", it is no longer scheduled")
+	}
+	return j, http.StatusOK, nil
+}
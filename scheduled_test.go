@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"mobile-push-broadcaster/dao"
+	"mobile-push-broadcaster/push"
+)
+
+func TestReloadInterruptedJobs(t *testing.T) {
+	store = dao.NewMemoryStore()
+	interrupted := newJob("app", map[string]string{"message": "hi"}, []string{dao.APNS, dao.GCM})
+	interrupted.Status = jobRunning
+	interrupted.Results[dao.APNS] = &push.Report{Platform: dao.APNS}
+	local := newJob("app", map[string]string{"message": "hi"}, []string{dao.GCM})
+	local.Status = jobRunning
+	local.Delivery = deliveryLocal
+	for _, j := range []*job{interrupted, local} {
+		if err := j.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := reloadScheduledJobs(); err != nil {
+		t.Fatal(err)
+	}
+	j, _ := loadJob(interrupted.ID)
+	if j.Status != jobFailed || j.Ended.IsZero() || j.Errors[dao.GCM] == "" || j.Errors[dao.APNS] != "" {
+		t.Errorf("interrupted job = %+v, want failed on gcm", j)
+	}
+	if j, _ := loadJob(local.ID); j.Status != jobRunning {
+		t.Errorf("local-time job status = %v, want %v", j.Status, jobRunning)
+	}
+}
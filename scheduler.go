@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduler runs tasks at their due time. Tasks are keyed so that they can
+// be rescheduled or canceled; tasks already due when scheduled run at once.
+type scheduler struct {
+	lock  sync.Mutex
+	tasks map[string]scheduledTask
+	wake  chan struct{}
+}
+
+type scheduledTask struct {
+	at  time.Time
+	run func()
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		tasks: make(map[string]scheduledTask),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// schedule registers run to be called at the given time, replacing any task
+// with the same key.
+func (s *scheduler) schedule(key string, at time.Time, run func()) {
+	s.lock.Lock()
+	s.tasks[key] = scheduledTask{at, run}
+	s.lock.Unlock()
+	s.notify()
+}
+
+// cancel removes a task and reports whether it was still pending.
+func (s *scheduler) cancel(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.tasks[key]
+	delete(s.tasks, key)
+	return ok
+}
+
+func (s *scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// loop runs the due tasks, each in its own goroutine, then sleeps until the
+// next one is due or a task is scheduled.
+func (s *scheduler) loop() {
+	for {
+		s.lock.Lock()
+		now := time.Now()
+		var next time.Time
+		var due []func()
+		for key, task := range s.tasks {
+			if !task.at.After(now) {
+				due = append(due, task.run)
+				delete(s.tasks, key)
+			} else if next.IsZero() || task.at.Before(next) {
+				next = task.at
+			}
+		}
+		s.lock.Unlock()
+
+		for _, run := range due {
+			go run()
+		}
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,212 @@
+// Package segment parses the boolean tag expressions used to target a
+// broadcast, such as "sports AND NOT beta" or "(news OR sports) AND fr".
+//
+// NOT binds tighter than AND, which binds tighter than OR. Keywords are
+// case insensitive and tags are lowercased, like the registered tags.
+package segment
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Expr is a parsed segment expression.
+type Expr interface {
+	// Match reports whether a device carrying the tags selected by has
+	// belongs to the segment.
+	Match(has func(tag string) bool) bool
+	String() string
+}
+
+type tagExpr string
+type notExpr struct{ x Expr }
+type andExpr struct{ x, y Expr }
+type orExpr struct{ x, y Expr }
+
+func (e tagExpr) Match(has func(string) bool) bool { return has(string(e)) }
+func (e notExpr) Match(has func(string) bool) bool { return !e.x.Match(has) }
+func (e andExpr) Match(has func(string) bool) bool { return e.x.Match(has) && e.y.Match(has) }
+func (e orExpr) Match(has func(string) bool) bool  { return e.x.Match(has) || e.y.Match(has) }
+
+func (e tagExpr) String() string { return string(e) }
+func (e notExpr) String() string { return "NOT " + e.x.String() }
+func (e andExpr) String() string { return "(" + e.x.String() + " AND " + e.y.String() + ")" }
+func (e orExpr) String() string  { return "(" + e.x.String() + " OR " + e.y.String() + ")" }
+
+type set map[string]bool
+
+// Select returns the tokens of all belonging to the segment, in the order
+// of all. withTag returns the tokens carrying a tag, typically from an
+// index, so that only the tags of the expression are looked at.
+func Select(e Expr, all []string, withTag func(tag string) []string) []string {
+	s := evalSet(e, all, withTag)
+	tokens := []string{}
+	for _, token := range all {
+		if s[token] {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// evalSet computes the set of tokens selected by e. Sets may contain
+// tokens outside of all, Select drops them.
+func evalSet(e Expr, all []string, withTag func(string) []string) set {
+	switch e := e.(type) {
+	case tagExpr:
+		s := make(set)
+		for _, token := range withTag(string(e)) {
+			s[token] = true
+		}
+		return s
+	case notExpr:
+		x := evalSet(e.x, all, withTag)
+		s := make(set)
+		for _, token := range all {
+			if !x[token] {
+				s[token] = true
+			}
+		}
+		return s
+	case andExpr:
+		x, y := evalSet(e.x, all, withTag), evalSet(e.y, all, withTag)
+		s := make(set)
+		for token := range x {
+			if y[token] {
+				s[token] = true
+			}
+		}
+		return s
+	case orExpr:
+		s := evalSet(e.x, all, withTag)
+		for token := range evalSet(e.y, all, withTag) {
+			s[token] = true
+		}
+		return s
+	}
+	return nil
+}
+
+// Parse parses a segment expression.
+func Parse(expr string) (Expr, error) {
+	p := &parser{tokens: lex(expr)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("segment: empty expression")
+	}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("segment: unexpected %q", p.tokens[p.pos])
+	}
+	return e, nil
+}
+
+func lex(expr string) []string {
+	var tokens []string
+	word := strings.Builder{}
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+	for _, r := range expr {
+		switch {
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) keyword(k string) bool {
+	if strings.EqualFold(p.peek(), k) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (Expr, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = orExpr{x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	x, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		y, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		x = andExpr{x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) not() (Expr, error) {
+	if p.keyword("NOT") {
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (Expr, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("segment: unexpected end of expression")
+	case token == "(":
+		p.pos++
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, fmt.Errorf("segment: missing )")
+		}
+		return x, nil
+	case token == ")", strings.EqualFold(token, "AND"), strings.EqualFold(token, "OR"):
+		return nil, fmt.Errorf("segment: unexpected %q", token)
+	}
+	p.pos++
+	return tagExpr(strings.ToLower(token)), nil
+}
@@ -0,0 +1,65 @@
+package segment
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelect(t *testing.T) {
+	all := []string{"a", "b", "c", "d"}
+	tags := map[string][]string{
+		"sports": {"a", "b", "x"},
+		"beta":   {"b", "c"},
+		"news":   {"d"},
+	}
+	withTag := func(tag string) []string { return tags[tag] }
+
+	tests := []struct {
+		expr string
+		want []string
+	}{
+		{"sports", []string{"a", "b"}},
+		{"sports AND NOT beta", []string{"a"}},
+		{"Sports and not BETA", []string{"a"}},
+		{"NOT sports", []string{"c", "d"}},
+		{"sports OR news AND NOT beta", []string{"a", "b", "d"}},
+		{"(sports OR news) AND NOT beta", []string{"a", "d"}},
+		{"NOT (sports OR beta)", []string{"d"}},
+		{"unknown", []string{}},
+	}
+	for _, test := range tests {
+		e, err := Parse(test.expr)
+		if err != nil {
+			t.Errorf("Parse(%q) error: %v", test.expr, err)
+			continue
+		}
+		if got := Select(e, all, withTag); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Select(%q) = %v, want %v", test.expr, got, test.want)
+		}
+		for _, token := range all {
+			has := func(tag string) bool {
+				for _, tagged := range tags[tag] {
+					if tagged == token {
+						return true
+					}
+				}
+				return false
+			}
+			selected := false
+			for _, want := range test.want {
+				selected = selected || want == token
+			}
+			if e.Match(has) != selected {
+				t.Errorf("Parse(%q).Match(%v) = %v, want %v", test.expr, token, !selected, selected)
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "sports AND", "AND beta", "(sports", "sports)", "sports beta", "NOT"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expr)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+
+	"mobile-push-broadcaster/push"
+	"mobile-push-broadcaster/segment"
+)
+
+// segmentFilter returns the filter of the pages of tokens streamed to a
+// segment expression, nil for an empty expression. The tokens of each tag
+// of the expression are read once from the tag index, then every page is
+// matched against them.
+func segmentFilter(platform string, app string, expr string) (func(tokens []string) []string, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	e, err := segment.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	tagged := make(map[string]map[string]bool)
+	return func(tokens []string) []string {
+		return segment.Select(e, tokens, func(tag string) []string {
+			if tagged[tag] == nil {
+				tagged[tag] = make(map[string]bool)
+				for _, token := range store.GetTokensWithTag(platform, app, tag) {
+					tagged[tag][token] = true
+				}
+			}
+			var withTag []string
+			for _, token := range tokens {
+				if tagged[tag][token] {
+					withTag = append(withTag, token)
+				}
+			}
+			return withTag
+		})
+	}, nil
+}
+
+// getAudience reports the number of devices of each platform targeted by a
+// segment, so the admin page can show it before sending.
+func getAudience(w http.ResponseWriter, r *http.Request) {
+	app := r.URL.Query().Get("app")
+	expr := r.URL.Query().Get("segment")
+	if _, err := getAppConfig(app); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	counts := make(map[string]int)
+	total := 0
+	for _, platform := range providers.Platforms() {
+		filter, err := segmentFilter(platform, app, expr)
+		if err != nil {
+			renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+			return
+		}
+		count := 0
+		if filter == nil {
+			count = store.GetNbTokens(platform, app)
+		} else {
+			store.ForEachTokenPage(platform, app, push.DefaultPageSize, func(tokens []string) error {
+				count += len(filter(tokens))
+				return nil
+			})
+		}
+		counts[platform] = count
+		total += count
+	}
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{"app": app, "segment": expr, "platforms": counts, "total": total})
+}
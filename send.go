@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"mobile-push-broadcaster/push"
+)
+
+// maxSendTokens bounds the tokens of a transactional send, larger
+// audiences go through /broadcast.
+const maxSendTokens = 1000
+
+// sendRequest is the JSON body of /send.
+type sendRequest struct {
+	App      string            `json:"app"`
+	Platform string            `json:"platform"`
+	Token    string            `json:"token"`
+	Tokens   []string          `json:"tokens"`
+	Payload  map[string]string `json:"payload"`
+}
+
+// tokenResult is the outcome reported for each token of a send or a bulk
+// request.
+type tokenResult struct {
+	Platform    string `json:"platform,omitempty"`
+	Token       string `json:"token"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+	Code        string `json:"code,omitempty"`
+	CanonicalID string `json:"canonical_id,omitempty"`
+}
+
+func newTokenResults(results []push.Result) []tokenResult {
+	tokenResults := make([]tokenResult, len(results))
+	for i, result := range results {
+		tokenResults[i] = tokenResult{Token: result.Token, Status: "sent", CanonicalID: result.CanonicalID}
+		switch {
+		case result.CanonicalID != "":
+			tokenResults[i].Status = "replaced"
+		case result.Err != nil && result.Unregistered:
+			tokenResults[i].Status = "removed"
+			tokenResults[i].Error = result.Err.Error()
+		case result.Err != nil:
+			tokenResults[i].Status = "failed"
+			tokenResults[i].Error = result.Err.Error()
+		}
+	}
+	return tokenResults
+}
+
+// send delivers a payload to specific tokens of an app and waits for the
+// provider to answer, returning the result of each token.
+func send(w http.ResponseWriter, r *http.Request) {
+	var req sendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "Invalid JSON body: " + err.Error()})
+		return
+	}
+	if req.Token != "" {
+		req.Tokens = append(req.Tokens, req.Token)
+	}
+	if req.App == "" || req.Platform == "" || len(req.Tokens) == 0 {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "app, platform and token or tokens are required"})
+		return
+	}
+	if len(req.Tokens) > maxSendTokens {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "At most " + strconv.Itoa(maxSendTokens) + " tokens can be sent at once"})
+		return
+	}
+	if _, err := getAppConfig(req.App); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	if _, ok := providers.Get(req.Platform); !ok {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "Unknown platform: " + req.Platform})
+		return
+	}
+
+	data := map[string]string{"app": req.App}
+	for key, value := range req.Payload {
+		data[key] = value
+	}
+	report, results, err := broadcaster.SendResults(req.Platform, push.Message{App: req.App, Data: data}, req.Tokens)
+	if err != nil {
+		renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{"status": "success", "report": report, "results": newTokenResults(results)})
+}
@@ -0,0 +1,167 @@
+// Package tokencheck validates the shape of the device tokens of each
+// platform before they are registered.
+//
+// APNs tokens are hexadecimal. They are 32 bytes long today, Apple warns
+// they may grow, so only the Strict mode requires 64 characters. FCM
+// registration tokens are URL-safe base64 strings, an instance ID and a
+// token separated by a colon, and the legacy GCM tokens have no colon.
+// Web Push tokens are the JSON of the browser subscriptions. HMS Push Kit
+// tokens and ADM registration IDs are opaque, only their characters and
+// length are checked, and the prefix of the registration IDs in the Strict
+// mode.
+package tokencheck
+
+import (
+	"strconv"
+	"strings"
+
+	"mobile-push-broadcaster/dao"
+	"mobile-push-broadcaster/webpush"
+)
+
+// Modes of validation of a platform.
+const (
+	// Default accepts the tokens of the documented shape.
+	Default = ""
+	// Strict only accepts the tokens of the current shape, 64 hex
+	// characters for APNs and instance ID tokens for FCM.
+	Strict = "strict"
+	// Off accepts any non-empty token.
+	Off = "off"
+)
+
+// Codes of the errors.
+const (
+	CodeEmpty           = "empty_token"
+	CodeUnknownPlatform = "unknown_platform"
+	CodeLength          = "invalid_length"
+	CodeCharacters      = "invalid_characters"
+	CodeFormat          = "invalid_format"
+)
+
+// Bounds of the lengths of the tokens.
+const (
+	apnsLength    = 64
+	apnsMaxLength = 200
+	fcmMinLength  = 32
+	fcmMaxLength  = 4096
+	hmsMinLength  = 32
+	hmsMaxLength  = 512
+	admMinLength  = 32
+	admMaxLength  = 2048
+	// fcmStrictLength is the shortest instance ID token.
+	fcmStrictLength = 140
+)
+
+// admPrefix starts the ADM registration IDs.
+const admPrefix = "amzn1.adm-registration."
+
+// Error is a token rejected by Check.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ValidMode reports whether mode is a mode of validation.
+func ValidMode(mode string) bool {
+	return mode == Default || mode == Strict || mode == Off
+}
+
+// Check validates a token of a platform in a mode, and returns nil when it
+// is valid.
+func Check(platform string, token string, mode string) *Error {
+	if token == "" {
+		return &Error{CodeEmpty, "The token is empty"}
+	}
+	switch platform {
+	case dao.APNS, dao.APNSSandbox:
+		if mode == Off {
+			return nil
+		}
+		return checkAPNS(token, mode)
+	case dao.GCM:
+		if mode == Off {
+			return nil
+		}
+		return checkFCM(token, mode)
+	case dao.HMS:
+		if mode == Off {
+			return nil
+		}
+		return checkOpaque("An HMS token", token, hmsMinLength, hmsMaxLength)
+	case dao.ADM:
+		if mode == Off {
+			return nil
+		}
+		if mode == Strict && !strings.HasPrefix(token, admPrefix) {
+			return &Error{CodeFormat, "An ADM registration ID starts with " + admPrefix}
+		}
+		return checkOpaque("An ADM registration ID", token, admMinLength, admMaxLength)
+	case dao.WebPush:
+		if mode == Off {
+			return nil
+		}
+		if _, err := webpush.ParseSubscription(token); err != nil {
+			return &Error{CodeFormat, strings.TrimPrefix(err.Error(), "webpush: ")}
+		}
+		return nil
+	}
+	return &Error{CodeUnknownPlatform, "Unknown platform: " + platform}
+}
+
+func checkAPNS(token string, mode string) *Error {
+	for _, c := range token {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return &Error{CodeCharacters, "An APNs token is hexadecimal"}
+		}
+	}
+	if mode == Strict && len(token) != apnsLength {
+		return &Error{CodeLength, "An APNs token is " + strconv.Itoa(apnsLength) + " characters long, not " + strconv.Itoa(len(token))}
+	}
+	if len(token) < apnsLength || len(token) > apnsMaxLength || len(token)%2 != 0 {
+		return &Error{CodeLength, "An APNs token is an even number of characters between " + strconv.Itoa(apnsLength) + " and " + strconv.Itoa(apnsMaxLength) + ", not " + strconv.Itoa(len(token))}
+	}
+	return nil
+}
+
+func checkFCM(token string, mode string) *Error {
+	for _, c := range token {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == ':') {
+			return &Error{CodeCharacters, "An FCM token holds letters, digits, '-', '_' and ':'"}
+		}
+	}
+	if len(token) < fcmMinLength || len(token) > fcmMaxLength {
+		return &Error{CodeLength, "An FCM token is between " + strconv.Itoa(fcmMinLength) + " and " + strconv.Itoa(fcmMaxLength) + " characters long, not " + strconv.Itoa(len(token))}
+	}
+	id, rest, found := strings.Cut(token, ":")
+	if found && (id == "" || rest == "" || strings.Contains(rest, ":")) {
+		return &Error{CodeFormat, "An FCM token is an instance ID and a token separated by a colon"}
+	}
+	if mode == Strict {
+		if !found {
+			return &Error{CodeFormat, "An FCM token is an instance ID and a token separated by a colon"}
+		}
+		if len(token) < fcmStrictLength {
+			return &Error{CodeLength, "An FCM token is at least " + strconv.Itoa(fcmStrictLength) + " characters long, not " + strconv.Itoa(len(token))}
+		}
+	}
+	return nil
+}
+
+// checkOpaque checks the characters and the length of the opaque tokens,
+// name is the token in the messages.
+func checkOpaque(name string, token string, min int, max int) *Error {
+	for _, c := range token {
+		if c <= ' ' || c > '~' {
+			return &Error{CodeCharacters, name + " holds printable ASCII characters"}
+		}
+	}
+	if len(token) < min || len(token) > max {
+		return &Error{CodeLength, name + " is between " + strconv.Itoa(min) + " and " + strconv.Itoa(max) + " characters long, not " + strconv.Itoa(len(token))}
+	}
+	return nil
+}
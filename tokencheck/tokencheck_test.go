@@ -0,0 +1,54 @@
+package tokencheck
+
+import (
+	"strings"
+	"testing"
+
+	"mobile-push-broadcaster/dao"
+)
+
+func TestCheck(t *testing.T) {
+	apns := strings.Repeat("a1", 32)
+	fcm := "dQw4w9WgXcQ:APA91b" + strings.Repeat("Xy_-9", 30)
+	keys := `"keys":{"p256dh":"BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4","auth":"BTBZMqHH6r4Tts7J_aSIgg"}`
+	tests := []struct {
+		platform string
+		token    string
+		mode     string
+		code     string
+	}{
+		{dao.APNS, apns, Default, ""},
+		{dao.APNSSandbox, strings.ToUpper(apns), Strict, ""},
+		{dao.APNS, apns + "00", Default, ""},
+		{dao.APNS, apns + "00", Strict, CodeLength},
+		{dao.APNS, apns + "0", Default, CodeLength},
+		{dao.APNS, apns[:62], Default, CodeLength},
+		{dao.APNS, "<" + apns[1:] + ">", Default, CodeCharacters},
+		{dao.APNS, "garbage", Off, ""},
+		{dao.APNS, "", Off, CodeEmpty},
+		{dao.GCM, fcm, Strict, ""},
+		{dao.GCM, "APA91b" + strings.Repeat("x", 140), Default, ""},
+		{dao.GCM, "APA91b" + strings.Repeat("x", 140), Strict, CodeFormat},
+		{dao.GCM, "abc:def:" + strings.Repeat("x", 40), Default, CodeFormat},
+		{dao.GCM, "short", Default, CodeLength},
+		{dao.GCM, fcm + " ", Default, CodeCharacters},
+		{dao.GCM, apns, Off, ""},
+		{dao.WebPush, `{"endpoint":"https://push.example.net/push/1",` + keys + `}`, Strict, ""},
+		{dao.WebPush, `{"endpoint":"http://push.example.net/push/1",` + keys + `}`, Default, CodeFormat},
+		{dao.WebPush, `{"endpoint":"https://push.example.net/push/1"}`, Default, CodeFormat},
+		{dao.WebPush, apns, Off, ""},
+		{dao.HMS, "IQAAAACy0kYgAAD" + strings.Repeat("Xy_-9", 20), Strict, ""},
+		{dao.HMS, "IQAAAACy0kYg AAD" + strings.Repeat("Xy_-9", 20), Default, CodeCharacters},
+		{dao.HMS, "short", Default, CodeLength},
+		{dao.ADM, "amzn1.adm-registration.v3." + strings.Repeat("Y29t", 30), Strict, ""},
+		{dao.ADM, strings.Repeat("Y29t", 30), Default, ""},
+		{dao.ADM, strings.Repeat("Y29t", 30), Strict, CodeFormat},
+		{"web", apns, Default, CodeUnknownPlatform},
+	}
+	for _, test := range tests {
+		err := Check(test.platform, test.token, test.mode)
+		if test.code == "" && err != nil || test.code != "" && (err == nil || err.Code != test.code) {
+			t.Errorf("Check(%s, %q, %q) = %v, want the code %q", test.platform, test.token, test.mode, err, test.code)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Package tokenio reads and writes token registrations as CSV or JSON
+// Lines, one registration per row or line, to move tokens between
+// servers.
+//
+// The CSV files start with a header row naming the columns, see Columns.
+// The custom metadata is a JSON object in its column and the tags are
+// separated by commas. Empty times are written as empty cells.
+package tokenio
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"mobile-push-broadcaster/dao"
+)
+
+// Formats.
+const (
+	CSV   = "csv"
+	JSONL = "jsonl"
+)
+
+// Columns are the columns of the CSV files.
+var Columns = []string{
+	"platform", "app", "token", "timezone", "tags", "user_id",
+	"first_registered", "last_registered", "app_version", "os_version",
+	"locale", "device_model", "custom",
+}
+
+// ContentType returns the MIME type of a format.
+func ContentType(format string) string {
+	if format == CSV {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+// Writer writes registrations to a file.
+type Writer interface {
+	Write(r dao.Registration) error
+	// Flush writes the buffered registrations.
+	Flush() error
+}
+
+// NewWriter returns a Writer of format to w.
+func NewWriter(w io.Writer, format string) (Writer, error) {
+	switch format {
+	case CSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	case JSONL:
+		buffered := bufio.NewWriter(w)
+		return &jsonlWriter{w: buffered, encoder: json.NewEncoder(buffered)}, nil
+	}
+	return nil, errors.New("Unknown format: " + format)
+}
+
+// RowError is returned by Read for an invalid row, the next rows can
+// still be read.
+type RowError struct {
+	Line int
+	Err  error
+}
+
+func (e *RowError) Error() string {
+	return "line " + strconv.Itoa(e.Line) + ": " + e.Err.Error()
+}
+
+// Reader reads registrations from a file. Read returns io.EOF after the
+// last registration.
+type Reader interface {
+	Read() (dao.Registration, error)
+	// Line is the line of the last registration read.
+	Line() int
+}
+
+// NewReader returns a Reader of format from r.
+func NewReader(r io.Reader, format string) (Reader, error) {
+	switch format {
+	case CSV:
+		return newCSVReader(r), nil
+	case JSONL:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		return &jsonlReader{scanner: scanner}, nil
+	}
+	return nil, errors.New("Unknown format: " + format)
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (w *csvWriter) Write(r dao.Registration) error {
+	if !w.header {
+		w.header = true
+		if err := w.w.Write(Columns); err != nil {
+			return err
+		}
+	}
+	custom := ""
+	if len(r.Info.Custom) > 0 {
+		data, err := json.Marshal(r.Info.Custom)
+		if err != nil {
+			return err
+		}
+		custom = string(data)
+	}
+	return w.w.Write([]string{
+		r.Platform, r.App, r.Token, r.Timezone, strings.Join(r.Tags, ","), r.UserID,
+		formatTime(r.Info.FirstRegistered), formatTime(r.Info.LastRegistered), r.Info.AppVersion, r.Info.OSVersion,
+		r.Info.Locale, r.Info.DeviceModel, custom,
+	})
+}
+
+func (w *csvWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type csvReader struct {
+	r *csv.Reader
+	// columns maps the columns of the header to their index.
+	columns map[string]int
+}
+
+func newCSVReader(r io.Reader) *csvReader {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	return &csvReader{r: reader}
+}
+
+func (r *csvReader) Line() int {
+	line, _ := r.r.FieldPos(0)
+	return line
+}
+
+func (r *csvReader) Read() (dao.Registration, error) {
+	if r.columns == nil {
+		header, err := r.r.Read()
+		if err != nil {
+			return dao.Registration{}, err
+		}
+		r.columns = make(map[string]int)
+		for i, column := range header {
+			r.columns[strings.TrimSpace(column)] = i
+		}
+		if _, ok := r.columns["token"]; !ok {
+			return dao.Registration{}, errors.New("The CSV header has no token column")
+		}
+	}
+
+	row, err := r.r.Read()
+	if parseErr, ok := err.(*csv.ParseError); ok {
+		return dao.Registration{}, &RowError{parseErr.Line, parseErr.Err}
+	}
+	if err != nil {
+		return dao.Registration{}, err
+	}
+	cell := func(column string) string {
+		if i, ok := r.columns[column]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	reg := dao.Registration{
+		Platform: cell("platform"),
+		App:      cell("app"),
+		Token:    cell("token"),
+		Timezone: cell("timezone"),
+		UserID:   cell("user_id"),
+		Info: dao.TokenInfo{
+			AppVersion:  cell("app_version"),
+			OSVersion:   cell("os_version"),
+			Locale:      cell("locale"),
+			DeviceModel: cell("device_model"),
+		},
+	}
+	if tags := cell("tags"); tags != "" {
+		reg.Tags = strings.Split(tags, ",")
+	}
+	if reg.Info.FirstRegistered, err = parseTime(cell("first_registered")); err != nil {
+		return reg, &RowError{r.Line(), err}
+	}
+	if reg.Info.LastRegistered, err = parseTime(cell("last_registered")); err != nil {
+		return reg, &RowError{r.Line(), err}
+	}
+	if custom := cell("custom"); custom != "" {
+		if err := json.Unmarshal([]byte(custom), &reg.Info.Custom); err != nil {
+			return reg, &RowError{r.Line(), errors.New("custom must be a JSON object of strings")}
+		}
+	}
+	return reg, nil
+}
+
+type jsonlWriter struct {
+	w       *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (w *jsonlWriter) Write(r dao.Registration) error {
+	return w.encoder.Encode(r)
+}
+
+func (w *jsonlWriter) Flush() error {
+	return w.w.Flush()
+}
+
+type jsonlReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *jsonlReader) Line() int {
+	return r.line
+}
+
+func (r *jsonlReader) Read() (dao.Registration, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := strings.TrimSpace(r.scanner.Text())
+		if line == "" {
+			continue
+		}
+		var reg dao.Registration
+		if err := json.Unmarshal([]byte(line), &reg); err != nil {
+			return reg, &RowError{r.line, err}
+		}
+		return reg, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return dao.Registration{}, err
+	}
+	return dao.Registration{}, io.EOF
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, errors.New("Invalid time " + value + ", it must be RFC3339")
+	}
+	return t, nil
+}
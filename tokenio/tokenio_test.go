@@ -0,0 +1,61 @@
+package tokenio
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"mobile-push-broadcaster/dao"
+)
+
+func TestRoundTrip(t *testing.T) {
+	registered := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	regs := []dao.Registration{
+		{Platform: dao.GCM, App: "app", Token: "t1", Timezone: "Europe/Paris", Tags: []string{"beta", "fr"}, UserID: "42",
+			Info: dao.TokenInfo{FirstRegistered: registered, LastRegistered: registered, AppVersion: "1.2", Custom: map[string]string{"plan": "pro"}}},
+		{Platform: dao.APNS, App: "app", Token: "t2"},
+	}
+
+	for _, format := range []string{CSV, JSONL} {
+		var buf bytes.Buffer
+		w, _ := NewWriter(&buf, format)
+		for _, reg := range regs {
+			if err := w.Write(reg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, _ := NewReader(&buf, format)
+		for _, want := range regs {
+			got, err := r.Read()
+			if err != nil {
+				t.Fatalf("%s: Read() error = %v", format, err)
+			}
+			if got.Token != want.Token || got.Platform != want.Platform || got.Timezone != want.Timezone || got.UserID != want.UserID ||
+				strings.Join(got.Tags, ",") != strings.Join(want.Tags, ",") || !got.Info.FirstRegistered.Equal(want.Info.FirstRegistered) ||
+				got.Info.AppVersion != want.Info.AppVersion || got.Info.Custom["plan"] != want.Info.Custom["plan"] {
+				t.Errorf("%s: Read() = %+v, want %+v", format, got, want)
+			}
+		}
+		if _, err := r.Read(); err != io.EOF {
+			t.Errorf("%s: Read() at the end = %v, want EOF", format, err)
+		}
+	}
+}
+
+func TestInvalidRow(t *testing.T) {
+	r, _ := NewReader(strings.NewReader("token,first_registered\nt1,yesterday\nt2,\n"), CSV)
+	if _, err := r.Read(); err == nil {
+		t.Fatal("Read() of an invalid time should fail")
+	} else if rowErr, ok := err.(*RowError); !ok || rowErr.Line != 2 {
+		t.Errorf("Read() error = %v, want a RowError of line 2", err)
+	}
+	if reg, err := r.Read(); err != nil || reg.Token != "t2" {
+		t.Errorf("Read() after an invalid row = %v, %v, want t2", reg, err)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"mobile-push-broadcaster/dao"
+	"mobile-push-broadcaster/tokencheck"
+	"mobile-push-broadcaster/tokenio"
+	"mobile-push-broadcaster/webpush"
+)
+
+// importBatch is the number of tokens written per transaction by an
+// import.
+const importBatch = 1000
+
+// maxImportErrors bounds the errors listed in an import report.
+const maxImportErrors = 100
+
+// importReport sums up an import.
+type importReport struct {
+	Read       int      `json:"read"`
+	Imported   int      `json:"imported"`
+	Duplicates int      `json:"duplicates"`
+	Invalid    int      `json:"invalid"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+func (report *importReport) invalid(line int, message string) {
+	report.Invalid++
+	if len(report.Errors) < maxImportErrors {
+		report.Errors = append(report.Errors, "line "+strconv.Itoa(line)+": "+message)
+	}
+}
+
+// exportTokens writes the tokens of an app on platforms, every platform
+// when empty, and returns their number.
+func exportTokens(w io.Writer, app string, platforms []string, format string) (int, error) {
+	writer, err := tokenio.NewWriter(w, format)
+	if err != nil {
+		return 0, err
+	}
+	if len(platforms) == 0 {
+		platforms = dao.Platforms
+	}
+	count := 0
+	for _, platform := range platforms {
+		err := store.ForEachToken(platform, app, func(r dao.Registration) error {
+			count++
+			return writer.Write(r)
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, writer.Flush()
+}
+
+// importTokens registers the tokens read from r in the app. The rows of
+// another app, with an unknown platform, a token rejected by the
+// validation of the app, an unknown timezone or a tag holding a comma,
+// are invalid. The tokens already registered, or repeated in r, are
+// skipped.
+func importTokens(r io.Reader, app string, format string) (importReport, error) {
+	var report importReport
+	reader, err := tokenio.NewReader(r, format)
+	if err != nil {
+		return report, err
+	}
+
+	seen := make(map[string]bool)
+	var batch []dao.Registration
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		added, err := store.RegisterTokens(batch)
+		for _, ok := range added {
+			if ok {
+				report.Imported++
+			}
+		}
+		batch = batch[:0]
+		return err
+	}
+
+	for {
+		reg, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if rowErr, ok := err.(*tokenio.RowError); ok {
+			report.Read++
+			report.invalid(rowErr.Line, rowErr.Err.Error())
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Read++
+
+		if reg.App == "" {
+			reg.App = app
+		}
+		switch {
+		case reg.App != app:
+			report.invalid(reader.Line(), "the token belongs to the app "+reg.App)
+			continue
+		case !dao.ValidPlatform(reg.Platform):
+			report.invalid(reader.Line(), "unknown platform "+reg.Platform)
+			continue
+		}
+		// A subscription is stored normalized, like by /webpush/register,
+		// whatever the key order or spacing of its JSON.
+		if reg.Platform == dao.WebPush {
+			sub, err := webpush.ParseSubscription(reg.Token)
+			if err != nil {
+				report.invalid(reader.Line(), tokencheck.CodeFormat+": "+err.Error())
+				continue
+			}
+			reg.Token = sub.String()
+		}
+		if err := checkToken(app, reg.Platform, reg.Token); err != nil {
+			report.invalid(reader.Line(), err.Code+": "+err.Message)
+			continue
+		}
+		if reg.Timezone != "" {
+			if _, err := time.LoadLocation(reg.Timezone); err != nil {
+				report.invalid(reader.Line(), "unknown timezone "+reg.Timezone)
+				continue
+			}
+		}
+		if err := dao.CheckTags(reg.Tags); err != nil {
+			report.invalid(reader.Line(), err.Error())
+			continue
+		}
+		if seen[reg.Platform+"#"+reg.Token] || store.HasToken(reg.Platform, app, reg.Token) {
+			report.Duplicates++
+			continue
+		}
+		seen[reg.Platform+"#"+reg.Token] = true
+
+		batch = append(batch, reg)
+		if len(batch) == importBatch {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, flush()
+}
+
+// transferFormat reads the format param, CSV by default.
+func transferFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		return tokenio.CSV, nil
+	case tokenio.CSV, tokenio.JSONL:
+		return format, nil
+	}
+	return "", errors.New("format must be csv or jsonl")
+}
+
+// exportAppTokens streams the tokens of an app, of the platform param or
+// every platform.
+func exportAppTokens(w http.ResponseWriter, r *http.Request) {
+	app := mux.Vars(r)["app"]
+	if _, err := getAppConfig(app); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	format, err := transferFormat(r)
+	if err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	var platforms []string
+	if platform := r.URL.Query().Get("platform"); platform != "" {
+		if !dao.ValidPlatform(platform) {
+			renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "Unknown platform: " + platform})
+			return
+		}
+		platforms = []string{platform}
+	}
+
+	w.Header().Set("Content-Type", tokenio.ContentType(format))
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+app+"-tokens."+format+"\"")
+	count, err := exportTokens(w, app, platforms, format)
+	if err != nil {
+		log.Println("Export of " + app + " interrupted after " + strconv.Itoa(count) + " tokens: " + err.Error())
+		return
+	}
+	log.Println("Exported " + strconv.Itoa(count) + " tokens of " + app)
+}
+
+// importAppTokens registers the tokens of the request body in an app.
+func importAppTokens(w http.ResponseWriter, r *http.Request) {
+	app := mux.Vars(r)["app"]
+	if _, err := getAppConfig(app); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+	format, err := transferFormat(r)
+	if err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	report, err := importTokens(r.Body, app, format)
+	if err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]interface{}{"status": "error", "message": err.Error(), "report": report})
+		return
+	}
+	log.Println("Imported " + strconv.Itoa(report.Imported) + " tokens in " + app)
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{"status": "success", "report": report})
+}
+
+// exportCommand writes the tokens of an app to a file, or stdout.
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	app := flags.String("app", "", "app of the tokens")
+	platform := flags.String("platform", "", "platform of the tokens, every platform when empty")
+	format := flags.String("format", tokenio.CSV, "csv or jsonl")
+	output := flags.String("output", "", "file written, stdout when empty")
+	if err := commandFlags(flags, args); err != nil {
+		return err
+	}
+	if *app == "" {
+		return errors.New("-app is required")
+	}
+	if *platform != "" && !dao.ValidPlatform(*platform) {
+		return errors.New("Unknown platform: " + *platform)
+	}
+
+	var err error
+	if store, err = openStore(); err != nil {
+		return err
+	}
+	defer store.Close()
+
+	w := os.Stdout
+	if *output != "" {
+		if w, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	var platforms []string
+	if *platform != "" {
+		platforms = []string{*platform}
+	}
+	count, err := exportTokens(w, *app, platforms, *format)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d tokens exported\n", count)
+	return nil
+}
+
+// importCommand registers the tokens of a file, or stdin, in an app.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	app := flags.String("app", "", "app of the tokens")
+	format := flags.String("format", tokenio.CSV, "csv or jsonl")
+	input := flags.String("input", "", "file read, stdin when empty")
+	if err := commandFlags(flags, args); err != nil {
+		return err
+	}
+	if *app == "" {
+		return errors.New("-app is required")
+	}
+
+	var err error
+	if store, err = openStore(); err != nil {
+		return err
+	}
+	defer store.Close()
+
+	r := os.Stdin
+	if *input != "" {
+		if r, err = os.Open(*input); err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+	report, err := importTokens(r, *app, *format)
+	fmt.Printf("%d read, %d imported, %d duplicates, %d invalid\n", report.Read, report.Imported, report.Duplicates, report.Invalid)
+	for _, message := range report.Errors {
+		fmt.Println("  " + message)
+	}
+	return err
+}
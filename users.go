@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"mobile-push-broadcaster/dao"
+	"mobile-push-broadcaster/push"
+)
+
+// userDevice describes a device of a user in the devices listing.
+type userDevice struct {
+	dao.Device
+	Timezone string         `json:"timezone,omitempty"`
+	Tags     []string       `json:"tags,omitempty"`
+	Info     *dao.TokenInfo `json:"info,omitempty"`
+}
+
+func listUserDevices(w http.ResponseWriter, r *http.Request) {
+	app := mux.Vars(r)["app"]
+	user := mux.Vars(r)["user"]
+
+	devices := []userDevice{}
+	for _, device := range store.GetUserDevices(app, user) {
+		d := userDevice{
+			Device:   device,
+			Timezone: store.GetTokenTimezone(device.Platform, app, device.Token),
+			Tags:     store.GetTokenTags(device.Platform, app, device.Token),
+		}
+		if info, ok := store.GetTokenInfo(device.Platform, app, device.Token); ok {
+			d.Info = &info
+		}
+		devices = append(devices, d)
+	}
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{"app": app, "user_id": user, "devices": devices})
+}
+
+// sendToUserRequest is the JSON body of /send/user. Platforms restricts the
+// send to some platforms, every platform of the user's devices when empty.
+type sendToUserRequest struct {
+	App       string            `json:"app"`
+	UserID    string            `json:"user_id"`
+	Platforms []string          `json:"platforms"`
+	Payload   map[string]string `json:"payload"`
+}
+
+// sendToUser delivers a payload to every device of a user and returns the
+// result of each device.
+func sendToUser(w http.ResponseWriter, r *http.Request) {
+	var req sendToUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "Invalid JSON body: " + err.Error()})
+		return
+	}
+	if req.App == "" || req.UserID == "" {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": "app and user_id are required"})
+		return
+	}
+	if _, err := getAppConfig(req.App); err != nil {
+		renderer.JSON(w, http.StatusBadRequest, map[string]string{"status": "error", "message": err.Error()})
+		return
+	}
+
+	selected := make(map[string]bool)
+	for _, platform := range req.Platforms {
+		selected[platform] = true
+	}
+	tokens := make(map[string][]string)
+	for _, device := range store.GetUserDevices(req.App, req.UserID) {
+		if len(selected) == 0 || selected[device.Platform] {
+			tokens[device.Platform] = append(tokens[device.Platform], device.Token)
+		}
+	}
+
+	data := map[string]string{"app": req.App}
+	for key, value := range req.Payload {
+		data[key] = value
+	}
+	msg := push.Message{App: req.App, Data: data}
+
+	reports := make(map[string]push.Report)
+	tokenResults := []tokenResult{}
+	for platform, toks := range tokens {
+		report, results, err := broadcaster.SendResults(platform, msg, toks)
+		if err != nil {
+			renderer.JSON(w, http.StatusInternalServerError, map[string]string{"status": "error", "message": err.Error()})
+			return
+		}
+		reports[platform] = report
+		for _, result := range newTokenResults(results) {
+			result.Platform = platform
+			tokenResults = append(tokenResults, result)
+		}
+	}
+	renderer.JSON(w, http.StatusOK, map[string]interface{}{"status": "success", "reports": reports, "results": tokenResults})
+}
@@ -0,0 +1,378 @@
+// Package webpush sends notifications to browsers with the Web Push
+// protocol, RFC 8030.
+//
+// A browser subscription is a push service endpoint and the keys of the
+// browser. Every payload is encrypted for its subscription with the
+// aes128gcm content coding of RFC 8291, and the application server
+// identifies itself to the push services with its VAPID key, RFC 8292.
+package webpush
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mobile-push-broadcaster/pool"
+)
+
+const (
+	// DefaultTTL is how long the push services keep a notification for an
+	// offline browser.
+	DefaultTTL = 4 * 7 * 24 * time.Hour
+
+	// MaxPayload is the largest payload sent in the single record of 4096
+	// bytes the push services must accept, header and tag included.
+	MaxPayload = recordSize - headerSize - 1 - tagSize
+
+	recordSize = 4096
+	headerSize = 16 + 4 + 1 + 65
+	tagSize    = 16
+	maxRetries = 2
+	// jwtLifetime is the validity of the VAPID JWT, at most 24 hours.
+	jwtLifetime = 12 * time.Hour
+)
+
+// Subscription is the PushSubscription of a browser, as serialized by its
+// toJSON method.
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     Keys   `json:"keys"`
+}
+
+// Keys are the keys of a subscription, base64url encoded.
+type Keys struct {
+	// P256dh is the P-256 public key of the browser.
+	P256dh string `json:"p256dh"`
+	// Auth is the authentication secret of the browser.
+	Auth string `json:"auth"`
+}
+
+// ParseSubscription decodes and validates the JSON of a subscription. The
+// keys are normalized to unpadded base64url.
+func ParseSubscription(data string) (*Subscription, error) {
+	var sub Subscription
+	if err := json.Unmarshal([]byte(data), &sub); err != nil {
+		return nil, errors.New("webpush: the subscription is not a JSON object")
+	}
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, errors.New("webpush: the endpoint of the subscription must be an https URL")
+	}
+	p256dh, err := decodeKey(sub.Keys.P256dh)
+	if err == nil {
+		_, err = ecdh.P256().NewPublicKey(p256dh)
+	}
+	if err != nil {
+		return nil, errors.New("webpush: keys.p256dh must be an uncompressed P-256 public key")
+	}
+	auth, err := decodeKey(sub.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return nil, errors.New("webpush: keys.auth must be a 16 bytes secret")
+	}
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(p256dh)
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(auth)
+	return &sub, nil
+}
+
+// String returns the JSON of the subscription, the token under which it is
+// registered.
+func (s *Subscription) String() string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// decodeKey decodes base64url, padded or not.
+func decodeKey(key string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+}
+
+// VAPID is the key an application server signs its requests with.
+type VAPID struct {
+	// Subject is a mailto: or https: contact of the application server.
+	Subject string
+
+	key       *ecdsa.PrivateKey
+	publicKey string
+
+	lock sync.Mutex
+	// jwts caches the signed JWT of each push service origin.
+	jwts map[string]cachedJWT
+}
+
+type cachedJWT struct {
+	jwt    string
+	expiry time.Time
+}
+
+// NewVAPID returns the VAPID key of a key pair encoded as the browsers and
+// the web-push libraries encode them: the uncompressed public point and
+// the private scalar, base64url.
+func NewVAPID(publicKey string, privateKey string, subject string) (*VAPID, error) {
+	if !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https:") {
+		return nil, errors.New("webpush: the VAPID subject must be a mailto: or https: URL")
+	}
+	scalar, err := decodeKey(privateKey)
+	if err != nil {
+		return nil, errors.New("webpush: the VAPID private key is not base64url")
+	}
+	ecdhKey, err := ecdh.P256().NewPrivateKey(scalar)
+	if err != nil {
+		return nil, fmt.Errorf("webpush: parsing the VAPID private key: %v", err)
+	}
+	public := ecdhKey.PublicKey().Bytes()
+	x, y := elliptic.Unmarshal(elliptic.P256(), public)
+	key := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, D: new(big.Int).SetBytes(scalar)}
+	if configured, err := decodeKey(publicKey); err != nil || !bytes.Equal(configured, public) {
+		return nil, errors.New("webpush: the VAPID public key is not the key of the private key")
+	}
+	return &VAPID{
+		Subject:   subject,
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(public),
+		jwts:      make(map[string]cachedJWT),
+	}, nil
+}
+
+// PublicKey returns the applicationServerKey of the subscriptions,
+// base64url.
+func (v *VAPID) PublicKey() string {
+	return v.publicKey
+}
+
+// authorization returns the Authorization header of a request to endpoint.
+func (v *VAPID) authorization(endpoint string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	audience := u.Scheme + "://" + u.Host
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	cached, ok := v.jwts[audience]
+	// Renew an hour early so that no request carries an expired JWT.
+	if !ok || now.After(cached.expiry.Add(-time.Hour)) {
+		cached.expiry = now.Add(jwtLifetime)
+		if cached.jwt, err = v.sign(audience, cached.expiry); err != nil {
+			return "", err
+		}
+		v.jwts[audience] = cached
+	}
+	return "vapid t=" + cached.jwt + ", k=" + v.publicKey, nil
+}
+
+// sign builds the ES256-signed JWT of an audience.
+func (v *VAPID) sign(audience string, expiry time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"exp": expiry.Unix(),
+		"sub": v.Subject,
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, v.key, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("webpush: signing the VAPID JWT: %v", err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Encrypt encrypts payload for a subscription with a new key and salt.
+func Encrypt(payload []byte, sub *Subscription) ([]byte, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encrypt(payload, sub, key, salt)
+}
+
+// encrypt encrypts payload in a single aes128gcm record, RFC 8188, keyed as
+// RFC 8291 describes with the key of the application server and salt.
+func encrypt(payload []byte, sub *Subscription, key *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(payload) > MaxPayload {
+		return nil, errors.New("webpush: the payload exceeds " + strconv.Itoa(MaxPayload) + " bytes")
+	}
+	p256dh, err := decodeKey(sub.Keys.P256dh)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := decodeKey(sub.Keys.Auth)
+	if err != nil {
+		return nil, err
+	}
+	browserKey, err := ecdh.P256().NewPublicKey(p256dh)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := key.ECDH(browserKey)
+	if err != nil {
+		return nil, err
+	}
+	serverKey := key.PublicKey().Bytes()
+
+	info := append([]byte("WebPush: info\x00"), p256dh...)
+	ikm := hkdf(auth, secret, append(info, serverKey...), 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	body := append([]byte{}, salt...)
+	body = binary.BigEndian.AppendUint32(body, recordSize)
+	body = append(body, byte(len(serverKey)))
+	body = append(body, serverKey...)
+	// The padding delimiter 2 marks the last record.
+	return gcm.Seal(body, nonce, append(append([]byte{}, payload...), 2), nil), nil
+}
+
+// hkdf derives a key of at most 32 bytes, RFC 5869.
+func hkdf(salt []byte, ikm []byte, info []byte, size int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:size]
+}
+
+// Result is the outcome of the notification sent to one subscription.
+type Result struct {
+	Token      string
+	StatusCode int
+	Err        error
+
+	// invalid is set when the token is not a subscription.
+	invalid bool
+}
+
+// Unregistered reports whether the subscription expired or was revoked,
+// meaning it should be removed from the store.
+func (r Result) Unregistered() bool {
+	return r.invalid || r.StatusCode == http.StatusNotFound || r.StatusCode == http.StatusGone
+}
+
+// Sender sends notifications with the VAPID key of one app.
+type Sender struct {
+	VAPID  *VAPID
+	Client *http.Client
+	// TTL is the TTL of the notifications, DefaultTTL when 0.
+	TTL time.Duration
+	// Workers is the number of notifications sent concurrently.
+	Workers int
+}
+
+// Send sends payload to every subscription concurrently and returns one
+// result per token, in the order of tokens. The tokens are subscriptions.
+func (s *Sender) Send(payload []byte, tokens []string) []Result {
+	results := make([]Result, len(tokens))
+	pool.Run(len(tokens), s.Workers, func(i int) {
+		results[i] = s.SendOne(payload, tokens[i])
+	})
+	return results
+}
+
+// SendOne sends payload to a single subscription, retrying transient
+// failures.
+func (s *Sender) SendOne(payload []byte, token string) Result {
+	sub, err := ParseSubscription(token)
+	if err != nil {
+		return Result{Token: token, Err: err, invalid: true}
+	}
+	body, err := Encrypt(payload, sub)
+	if err != nil {
+		return Result{Token: token, Err: err}
+	}
+
+	var result Result
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+		}
+		var retry bool
+		result, retry = s.post(token, sub.Endpoint, body)
+		if !retry {
+			break
+		}
+	}
+	return result
+}
+
+func (s *Sender) post(token string, endpoint string, body []byte) (Result, bool) {
+	result := Result{Token: token}
+
+	authorization, err := s.VAPID.authorization(endpoint, time.Now())
+	if err != nil {
+		result.Err = err
+		return result, false
+	}
+	ttl := s.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		result.Err = err
+		return result, false
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(ttl/time.Second)))
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		result.Err = err
+		return result, true
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return result, false
+	}
+	result.Err = fmt.Errorf("webpush: %s (HTTP %d)", strings.TrimSpace(string(respBody)), resp.StatusCode)
+	return result, resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func (s *Sender) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
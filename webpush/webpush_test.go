@@ -0,0 +1,127 @@
+package webpush
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decode(t *testing.T, s string) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestEncrypt checks the example of RFC 8291, appendix A.
+func TestEncrypt(t *testing.T) {
+	key, err := ecdh.P256().NewPrivateKey(decode(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := &Subscription{
+		Endpoint: "https://push.example.net/push/JzLQ3raZJfFBR0aqvOMsLrt54w4rJUsV",
+		Keys: Keys{
+			P256dh: "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",
+			Auth:   "BTBZMqHH6r4Tts7J_aSIgg",
+		},
+	}
+	body, err := encrypt([]byte("When I grow up, I want to be a watermelon"), sub, key, decode(t, "DGv6ra1nlYgDCS1FRnbzlw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The example uses a record size of 4096 too.
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if got := base64.RawURLEncoding.EncodeToString(body); got != want {
+		t.Errorf("encrypt() = %v, want %v", got, want)
+	}
+}
+
+func TestSend(t *testing.T) {
+	browserKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	serverKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	vapid, err := NewVAPID(base64.RawURLEncoding.EncodeToString(serverKey.PublicKey().Bytes()), base64.RawURLEncoding.EncodeToString(serverKey.Bytes()), "mailto:push@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validJWT(r.Header.Get("Authorization"), vapid.PublicKey(), server.URL) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	subscription := func(path string) string {
+		sub := &Subscription{
+			Endpoint: server.URL + path,
+			Keys: Keys{
+				P256dh: base64.RawURLEncoding.EncodeToString(browserKey.PublicKey().Bytes()),
+				Auth:   "BTBZMqHH6r4Tts7J_aSIgg==",
+			},
+		}
+		return sub.String()
+	}
+	sub, err := ParseSubscription(subscription("/a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Keys.Auth != "BTBZMqHH6r4Tts7J_aSIgg" {
+		t.Errorf("sub.Keys.Auth = %v, want the unpadded key", sub.Keys.Auth)
+	}
+
+	sender := &Sender{VAPID: vapid, Client: server.Client()}
+	results := sender.Send([]byte(`{"message":"hello"}`), []string{sub.String(), subscription("/gone"), "{}"})
+	if results[0].Err != nil || results[0].StatusCode != http.StatusCreated {
+		t.Errorf("results[0] = %+v, want a sent notification", results[0])
+	}
+	if !results[1].Unregistered() || results[1].StatusCode != http.StatusGone {
+		t.Errorf("results[1] = %+v, want a gone subscription", results[1])
+	}
+	if !results[2].Unregistered() {
+		t.Errorf("results[2] = %+v, want an invalid subscription", results[2])
+	}
+}
+
+// validJWT verifies the signature and the audience of a VAPID header.
+func validJWT(authorization string, publicKey string, audience string) bool {
+	jwt, ok := strings.CutPrefix(authorization, "vapid t=")
+	if !ok {
+		return false
+	}
+	jwt, k, ok := strings.Cut(jwt, ", k=")
+	parts := strings.Split(jwt, ".")
+	if !ok || k != publicKey || len(parts) != 3 {
+		return false
+	}
+	public, _ := base64.RawURLEncoding.DecodeString(k)
+	x, y := elliptic.Unmarshal(elliptic.P256(), public)
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if x == nil || len(signature) != 64 || !strings.Contains(string(claims), `"aud":"`+audience+`"`) {
+		return false
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, sum[:], r, s)
+}